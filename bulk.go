@@ -0,0 +1,179 @@
+package m_cache
+
+import (
+	"m_cache/policies"
+	"sync/atomic"
+	"time"
+)
+
+// SetMulti sets all the items with the same expiration. It takes the lock of
+// every shard of the dict and the one of the eviction policy once, and
+// schedules the expirations in a single message, which makes it cheaper than
+// as many calls to Set. Items refused by the eviction policy are skipped.
+func (c *cache) SetMulti(items map[string]interface{}, d time.Duration) {
+	if c.Closed() || len(items) == 0 {
+		return
+	}
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	costs := make(map[string]int64, len(items))
+	for k, x := range items {
+		costs[k] = c.costOf(k, x)
+	}
+	keys := c.makeRoomMulti(costs)
+	vals := make(map[string]interface{}, len(keys))
+	entries := make(map[string]*entry, len(keys))
+	var cost int64
+	for _, k := range keys {
+		e := c.newEntry(items[k], costs[k], d, c.slidingOf(d))
+		vals[k], entries[k] = e, e
+		cost += e.cost
+	}
+	c.flushMu.RLock()
+	atomic.AddInt64(&c.cost, cost)
+	olds := c.items.SwapMulti(vals)
+	policies.PromoteMulti(c.policy, keys)
+	if len(keys) > 0 && d > 0 {
+		// the first entry expires first
+		c.expiresBy(entries[keys[0]].expiresAt())
+	}
+	if c.expirer != nil {
+		c.expirer.scheduleMulti(entries)
+	}
+	c.flushMu.RUnlock()
+	atomic.AddUint64(&c.stats.sets, uint64(len(keys)))
+	now := c.now()
+	for _, k := range keys {
+		old, existed := olds[k]
+		if !existed {
+			continue
+		}
+		if oe := old.(*entry); oe.expired(now) {
+			c.removed(k, oe, Expired, nil)
+		} else {
+			c.removed(k, oe, Replaced, items[k])
+		}
+	}
+}
+
+// makeRoomMulti evicts items until the items of the given costs fit, and
+// returns the keys admitted. It does what makeRoom does for every key, taking
+// into account the room reserved by the keys admitted before, and leaves out
+// the keys which don't fit once the eviction policy has nothing to evict. The
+// victims are chosen in a single critical section of the policy, and removed
+// once it's over.
+func (c *cache) makeRoomMulti(costs map[string]int64) []string {
+	maxCost := c.MaxCost()
+	keys := make([]string, 0, len(costs))
+	for k, cost := range costs {
+		if maxCost <= 0 || cost <= maxCost {
+			keys = append(keys, k)
+		}
+	}
+	c.reclaimExpired()
+	olds := make(map[string]*entry, len(keys))
+	vals, exists := c.items.GetMulti(keys)
+	for i, k := range keys {
+		if exists[i] {
+			olds[k] = vals[i].(*entry)
+		}
+	}
+	capacity := int(c.policy.Capacity())
+	// count and cost are the room taken by the admitted keys on top of the
+	// stored items, minus the room of the victims
+	var (
+		count    int
+		cost     int64
+		admitted = make(map[string]bool, len(keys))
+		victims  = make(map[string]struct{})
+	)
+	// full counts the room taken by k once it fits, k is then admitted
+	full := func(k string) bool {
+		var oldCost int64
+		old, exists := olds[k]
+		if exists {
+			oldCost = old.cost
+		}
+		if !exists && c.items.Len()+count >= capacity {
+			return true
+		}
+		if maxCost > 0 && atomic.LoadInt64(&c.cost)+cost+costs[k]-oldCost > maxCost {
+			return true
+		}
+		admitted[k] = true
+		cost += costs[k] - oldCost
+		if !exists {
+			count++
+		}
+		return false
+	}
+	evicted := func(ek string) {
+		v, found := c.items.Get(ek)
+		if _, seen := victims[ek]; seen || !found {
+			return
+		}
+		e := v.(*entry)
+		victims[ek] = struct{}{}
+		count--
+		cost -= e.cost
+		if _, ok := olds[ek]; ok {
+			// the evicted item was going to be replaced, its key is a new one now
+			delete(olds, ek)
+			if admitted[ek] {
+				count++
+				cost += e.cost
+			}
+		}
+	}
+	kept := policies.AdmitMulti(c.policy, keys, full, evicted)
+	for ek := range victims {
+		c.evictVictim(ek)
+	}
+	return kept
+}
+
+// GetMulti returns the values of the keys found in the m-cache, it takes the
+// lock of every shard of the dict and the one of the eviction policy once.
+func (c *cache) GetMulti(keys []string) map[string]interface{} {
+	found := make(map[string]interface{}, len(keys))
+	if c.Closed() {
+		return found
+	}
+	vals, exists := c.items.GetMulti(keys)
+	now := c.now()
+	hits := make([]string, 0, len(keys))
+	for i, k := range keys {
+		v := vals[i]
+		if !exists[i] || v.(*entry).expired(now) {
+			continue
+		}
+		e := v.(*entry)
+		c.accessed(k, e, now)
+		found[k] = e.value
+		hits = append(hits, k)
+	}
+	atomic.AddUint64(&c.stats.hits, uint64(len(hits)))
+	atomic.AddUint64(&c.stats.misses, uint64(len(keys)-len(hits)))
+	policies.PromoteIfExistMulti(c.policy, hits)
+	return found
+}
+
+// DeleteMulti deletes the keys from the m-cache, it takes the lock of every
+// shard of the dict and the one of the eviction policy once.
+func (c *cache) DeleteMulti(keys []string) {
+	if c.Closed() || len(keys) == 0 {
+		return
+	}
+	if c.expirer != nil {
+		c.expirer.cancelMulti(keys)
+	}
+	vals := c.items.RemoveMulti(keys)
+	policies.EvictMulti(c.policy, keys)
+	for _, k := range keys {
+		if v, existed := vals[k]; existed {
+			delete(vals, k)
+			c.removed(k, v.(*entry), Explicit, nil)
+		}
+	}
+}
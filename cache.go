@@ -1,10 +1,13 @@
 package m_cache
 
 import (
+	"errors"
 	"fmt"
+	"m_cache/clock"
 	"m_cache/dict"
 	"m_cache/policies"
-	"m_cache/timewheel"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,31 +16,153 @@ const (
 	DefaultExpiration time.Duration = 0
 )
 
+// ErrClosed is returned by the operations of a closed Cache.
+var ErrClosed = errors.New("m-cache is closed")
+
+// wheelSlots is the number of slots of each level of the time wheel, longer
+// expirations are handled by adding levels.
+const wheelSlots = 64
+
 type Cache struct {
 	*cache
 	// If this is confusing, see the comment at the bottom of New()
 }
 
 type cache struct {
+	// 64-bit words accessed atomically come first to keep them aligned on 32-bit platforms.
+	stats   stats
+	cost    int64
+	maxCost int64
+	// nextExpiration is a UnixNano time no later than the expiration of
+	// every item, 0 if none expires
+	nextExpiration    int64
 	defaultExpiration time.Duration
 	items             dict.ConcurrentMap
-	onEvicted         func(string, interface{})
-	tw                *timewheel.TimeWheel
+	onRemoval         func(RemovalEvent)
+	expirer           expirer
 	policy            policies.EvictionPolicy
+	loads             *loadGroup
+	sizer             func(key string, val interface{}) int64
+	codec             Codec
+	tags              *tagIndex
+	clock             clock.Clock
+	expirationEngine  ExpirationEngine
+	sampleSize        int
+	maxExpiredRatio   float64
+	notifyOnClose     bool
+	refreshLoader     KeyLoader
+	refreshGrace      time.Duration
+	slidingExpiration bool
+	closed            int32
+	// reclaiming is set while the expired items are being reclaimed
+	reclaiming int32
+	closeOnce  sync.Once
+	// flushMu is held for writing by Flush, and for reading by the writers
+	// while they store an item, so that none is left half stored by a Flush
+	flushMu sync.RWMutex
+}
+
+// entry is what the m-cache stores in its dict for every key.
+type entry struct {
+	// expiration is the UnixNano time the entry expires at, 0 if it doesn't.
+	// It's accessed atomically since TTLs can change after the entry is stored.
+	expiration int64
+	// refreshAt is the UnixNano time the entry becomes stale and gets
+	// reloaded, 0 if it doesn't. It's accessed atomically since it moves
+	// along with the expiration.
+	refreshAt int64
+	// sliding is the time in nanoseconds the entry lives after its last
+	// access, 0 if its expiration doesn't slide. It's accessed atomically
+	// since Persist and ExpireAt stop the sliding.
+	sliding int64
+	// refreshing is set while the entry is being reloaded
+	refreshing int32
+	value      interface{}
+	cost       int64
+	// tags is nil if the entry has no tag
+	tags *tagSet
+}
+
+// withValue returns a copy of the entry holding x, which doesn't get stale:
+// the refresh loader would overwrite x with the value it was computed from.
+func (e *entry) withValue(x interface{}) *entry {
+	return &entry{
+		expiration: e.expiresAt(),
+		value:      x,
+		cost:       e.cost,
+		sliding:    int64(e.slides()),
+		tags:       e.tags,
+	}
+}
+
+func (e *entry) expiresAt() int64 {
+	return atomic.LoadInt64(&e.expiration)
 }
 
-func New(defaultExpiration, cleanupInterval time.Duration, m dict.ConcurrentMap, p policies.EvictionPolicy) *Cache {
-	return newCacheWithTimer(defaultExpiration, cleanupInterval, m, p)
+func (e *entry) setExpiration(expiration int64) {
+	atomic.StoreInt64(&e.expiration, expiration)
 }
 
-func newCacheWithTimer(de time.Duration, ci time.Duration, m dict.ConcurrentMap, p policies.EvictionPolicy) *Cache {
+func (e *entry) staleAt() int64 {
+	return atomic.LoadInt64(&e.refreshAt)
+}
+
+func (e *entry) setStaleAt(refreshAt int64) {
+	atomic.StoreInt64(&e.refreshAt, refreshAt)
+}
+
+// slides returns how much the expiration of the entry slides on every read.
+func (e *entry) slides() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.sliding))
+}
+
+// fixExpiration sets the expiration of the entry, which stops sliding.
+func (e *entry) fixExpiration(expiration int64) {
+	atomic.StoreInt64(&e.sliding, 0)
+	e.setExpiration(expiration)
+}
+
+// expired tells whether the entry has expired at the UnixNano time now.
+func (e *entry) expired(now int64) bool {
+	expiration := e.expiresAt()
+	return expiration > 0 && now >= expiration
+}
+
+// newEntry returns an entry expiring after d, which then slides by the given
+// duration on every read if not 0. With a refresh loader, the entry becomes
+// stale after d and only expires after the grace period.
+func (c *cache) newEntry(x interface{}, cost int64, d, sliding time.Duration) *entry {
+	if d <= 0 {
+		return &entry{value: x, cost: cost}
+	}
+	if c.refreshLoader != nil {
+		d += c.refreshGrace
+	}
+	return c.entryExpiringAt(x, cost, c.clock.Now().Add(d).UnixNano(), sliding)
+}
+
+// entryExpiringAt returns an entry expiring at the UnixNano time expiration.
+// With a refresh loader, the entry becomes stale the grace period before.
+func (c *cache) entryExpiringAt(x interface{}, cost int64, expiration int64, sliding time.Duration) *entry {
+	e := &entry{expiration: expiration, value: x, cost: cost, sliding: int64(sliding)}
+	if c.refreshLoader != nil {
+		e.refreshAt = expiration - int64(c.refreshGrace)
+	}
+	return e
+}
+
+func New(defaultExpiration, cleanupInterval time.Duration, m dict.ConcurrentMap, p policies.EvictionPolicy, opts ...Option) *Cache {
+	return newCacheWithTimer(defaultExpiration, cleanupInterval, m, p, opts...)
+}
+
+func newCacheWithTimer(de time.Duration, ci time.Duration, m dict.ConcurrentMap, p policies.EvictionPolicy, opts ...Option) *Cache {
 	c := newCache(de, m, p)
-	C := &Cache{c}
-	if ci > 0 {
-		tw := timewheel.New(ci, 3600)
-		tw.Start()
-		c.tw = tw
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.loads.clock = c.clock
+	C := &Cache{c}
+	c.expirer = newExpirer(c, ci)
 	return C
 }
 
@@ -49,31 +174,73 @@ func newCache(de time.Duration, m dict.ConcurrentMap, p policies.EvictionPolicy)
 		defaultExpiration: de,
 		items:             m,
 		policy:            p,
+		loads:             newLoadGroup(),
+		tags:              newTagIndex(),
+		codec:             GobCodec{},
+		clock:             clock.Real,
 	}
 	return c
 }
 
 func (c *cache) Set(k string, x interface{}, d time.Duration) {
+	c.SetWithCost(k, x, c.costOf(k, x), d)
+}
+
+// SetWithCost sets an item whose cost is counted against the maximum cost of
+// the m-cache instead of the one given by its Sizer.
+func (c *cache) SetWithCost(k string, x interface{}, cost int64, d time.Duration) {
 	if d == DefaultExpiration {
 		d = c.defaultExpiration
 	}
-	if c.items.Len() >= int(c.policy.Capacity()) {
-		ek := c.policy.NowEvict()
-		if c.tw != nil {
-			c.tw.RemoveJob(ek)
-		}
-		c.items.Remove(ek)
+	c.set(k, x, cost, d, c.slidingOf(d), nil)
+}
+
+// SetSliding sets an item which expires once it hasn't been read for d,
+// whether the m-cache uses sliding expiration or not.
+func (c *cache) SetSliding(k string, x interface{}, d time.Duration) {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	c.set(k, x, c.costOf(k, x), d, d, nil)
+}
+
+// slidingOf returns how much the expiration of an item set for d slides.
+func (c *cache) slidingOf(d time.Duration) time.Duration {
+	if c.slidingExpiration && d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (c *cache) set(k string, x interface{}, cost int64, d, sliding time.Duration, tags []string) {
+	if c.Closed() {
+		return
 	}
-	c.items.Put(k, x)
+	c.store(k, c.newEntry(x, cost, d, sliding), tags)
+}
+
+// store sets the entry e of k once there is room for it.
+func (c *cache) store(k string, e *entry, tags []string) {
+	if !c.makeRoom(k, e.cost) {
+		return
+	}
+	if len(tags) > 0 {
+		e.tags = newTagSet(k, tags)
+		c.tags.add(e.tags)
+	}
+	c.flushMu.RLock()
+	atomic.AddInt64(&c.cost, e.cost)
+	old, existed := c.items.Swap(k, e)
 	c.policy.Promote(k)
-	if c.tw != nil {
-		c.tw.AddJob(k, d, func() {
-			c.items.Remove(k)
-			c.policy.Evict(k)
-			if c.onEvicted != nil {
-				c.onEvicted(k, x)
-			}
-		})
+	c.scheduleExpiration(k, e)
+	c.flushMu.RUnlock()
+	atomic.AddUint64(&c.stats.sets, 1)
+	if existed {
+		if oe := old.(*entry); oe.expired(c.now()) {
+			c.removed(k, oe, Expired, nil)
+		} else {
+			c.removed(k, oe, Replaced, e.value)
+		}
 	}
 }
 
@@ -82,75 +249,363 @@ func (c *cache) SetDefault(k string, x interface{}) {
 }
 
 func (c *cache) Add(k string, x interface{}, d time.Duration) error {
+	if c.Closed() {
+		return ErrClosed
+	}
 	if d == DefaultExpiration {
 		d = c.defaultExpiration
 	}
-	if c.items.Len() >= int(c.policy.Capacity()) {
-		ek := c.policy.NowEvict()
-		if c.tw != nil {
-			c.tw.RemoveJob(ek)
-		}
-		c.items.Remove(ek)
+	c.removeExpired(k)
+	if _, exists := c.items.Get(k); exists {
+		atomic.AddUint64(&c.stats.addsFailed, 1)
+		return fmt.Errorf("item %s already exists", k)
+	}
+	cost := c.costOf(k, x)
+	if !c.makeRoom(k, cost) {
+		atomic.AddUint64(&c.stats.addsFailed, 1)
+		return fmt.Errorf("item %s isn't admitted by the eviction policy", k)
 	}
-	if c.items.PutIfAbsent(k, x) == 0 {
+	e := c.newEntry(x, cost, d, c.slidingOf(d))
+	c.flushMu.RLock()
+	defer c.flushMu.RUnlock()
+	if c.items.PutIfAbsent(k, e) == 0 {
+		atomic.AddUint64(&c.stats.addsFailed, 1)
 		return fmt.Errorf("item %s already exists", k)
 	}
+	atomic.AddInt64(&c.cost, cost)
 	c.policy.Promote(k)
-	if c.tw != nil {
-		c.tw.AddJob(k, d, func() {
-			c.items.Remove(k)
-			c.policy.Evict(k)
-			if c.onEvicted != nil {
-				c.onEvicted(k, x)
-			}
-		})
-	}
+	c.scheduleExpiration(k, e)
 	return nil
 }
 
 func (c *cache) Replace(k string, x interface{}, d time.Duration) error {
+	if c.Closed() {
+		return ErrClosed
+	}
 	if d == DefaultExpiration {
 		d = c.defaultExpiration
 	}
-	if c.items.Len() >= int(c.policy.Capacity()) {
-		ek := c.policy.NowEvict()
-		if c.tw != nil {
-			c.tw.RemoveJob(ek)
-		}
-		c.items.Remove(ek)
+	c.removeExpired(k)
+	if _, exists := c.items.Get(k); !exists {
+		atomic.AddUint64(&c.stats.replacesFailed, 1)
+		return fmt.Errorf("item %s doesn't exists", k)
+	}
+	cost := c.costOf(k, x)
+	if !c.makeRoom(k, cost) {
+		atomic.AddUint64(&c.stats.replacesFailed, 1)
+		return fmt.Errorf("item %s isn't admitted by the eviction policy", k)
 	}
-	if c.items.PutIfExists(k, x) == 0 {
+	e := c.newEntry(x, cost, d, c.slidingOf(d))
+	var old interface{}
+	c.flushMu.RLock()
+	_, existed := c.items.Compute(k, func(v interface{}, exists bool) (interface{}, bool) {
+		if old = v; exists {
+			// e isn't stored yet, it carries on the tags of k
+			e.tags = v.(*entry).tags
+		}
+		return e, exists
+	})
+	if !existed {
+		c.flushMu.RUnlock()
+		atomic.AddUint64(&c.stats.replacesFailed, 1)
 		return fmt.Errorf("item %s doesn't exists", k)
 	}
+	atomic.AddInt64(&c.cost, cost)
 	c.policy.Promote(k)
-	if c.tw != nil {
-		c.tw.AddJob(k, d, func() {
-			c.items.Remove(k)
-			c.policy.Evict(k)
-			if c.onEvicted != nil {
-				c.onEvicted(k, x)
+	c.scheduleExpiration(k, e)
+	c.flushMu.RUnlock()
+	c.replaced(k, old.(*entry), e)
+	return nil
+}
+
+func (c *cache) scheduleExpiration(k string, e *entry) {
+	expiration := e.expiresAt()
+	if expiration == 0 {
+		return
+	}
+	c.expiresBy(expiration)
+	if c.expirer == nil {
+		return
+	}
+	c.expirer.schedule(k, e, time.Duration(expiration-c.now()))
+}
+
+// removeExpired removes k if it has expired, and tells whether it did.
+func (c *cache) removeExpired(k string) bool {
+	now := c.now()
+	v, removed := c.items.RemoveIf(k, func(v interface{}) bool {
+		return v.(*entry).expired(now)
+	})
+	if !removed {
+		return false
+	}
+	c.policy.Evict(k)
+	c.removed(k, v.(*entry), Expired, nil)
+	return true
+}
+
+// expiresBy lowers the next expiration to the UnixNano time expiration.
+func (c *cache) expiresBy(expiration int64) {
+	for {
+		next := atomic.LoadInt64(&c.nextExpiration)
+		if next != 0 && next <= expiration || atomic.CompareAndSwapInt64(&c.nextExpiration, next, expiration) {
+			return
+		}
+	}
+}
+
+// reclaimExpired removes the expired items if some may be left, so that the
+// eviction policy doesn't evict live items in their place.
+func (c *cache) reclaimExpired() {
+	now := c.now()
+	if next := atomic.LoadInt64(&c.nextExpiration); next == 0 || now < next {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.reclaiming, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.reclaiming, 0)
+	// the items stored meanwhile lower it again
+	atomic.StoreInt64(&c.nextExpiration, 0)
+	var (
+		expired []string
+		next    int64
+	)
+	c.items.ForEach(func(k string, v interface{}) bool {
+		switch expiration := v.(*entry).expiresAt(); {
+		case expiration == 0:
+		case now >= expiration:
+			expired = append(expired, k)
+		case next == 0 || expiration < next:
+			next = expiration
+		}
+		return true
+	})
+	if next > 0 {
+		c.expiresBy(next)
+	}
+	for _, k := range expired {
+		c.removeExpired(k)
+	}
+}
+
+// evictVictim removes ek, evicted by the eviction policy. It's notified as
+// expired if it was, which happens when it wasn't reclaimed yet.
+func (c *cache) evictVictim(ek string) (*entry, bool) {
+	if c.expirer != nil {
+		c.expirer.cancel(ek)
+	}
+	v, existed := c.items.Remove(ek)
+	if !existed {
+		return nil, false
+	}
+	e := v.(*entry)
+	if e.expired(c.now()) {
+		c.removed(ek, e, Expired, nil)
+	} else {
+		c.removed(ek, e, Capacity, nil)
+	}
+	return e, true
+}
+
+func (c *cache) now() int64 {
+	return c.clock.Now().UnixNano()
+}
+
+func (c *cache) costOf(k string, x interface{}) int64 {
+	if c.sizer != nil {
+		return c.sizer(k, x)
+	}
+	return 1
+}
+
+// full tells whether an item of the given cost can't be stored under k
+// without evicting another one first.
+func (c *cache) full(k string, cost int64) bool {
+	var oldCost int64
+	old, exists := c.items.Get(k)
+	if exists {
+		oldCost = old.(*entry).cost
+	}
+	if !exists && c.items.Len() >= int(c.policy.Capacity()) {
+		return true
+	}
+	maxCost := c.MaxCost()
+	return maxCost > 0 && atomic.LoadInt64(&c.cost)+cost-oldCost > maxCost
+}
+
+// makeRoom evicts items until an item of the given cost fits under k, once
+// the expired items are reclaimed. It returns false when the eviction policy
+// refuses to admit k, when the item costs more than the whole m-cache or when
+// the policy has nothing left to evict.
+func (c *cache) makeRoom(k string, cost int64) bool {
+	if maxCost := c.MaxCost(); maxCost > 0 && cost > maxCost {
+		return false
+	}
+	if c.full(k, cost) {
+		c.reclaimExpired()
+	}
+	for c.full(k, cost) {
+		var ek string
+		_, exists := c.items.Get(k)
+		if ap, ok := c.policy.(policies.AdmissionPolicy); ok && !exists {
+			if ek = ap.Admit(k); ek == k {
+				return false
 			}
-		})
+		} else {
+			ek = c.policy.NowEvict()
+		}
+		if ek == "" {
+			return false
+		}
+		c.evictVictim(ek)
 	}
-	return nil
+	return true
+}
+
+// shrink evicts items until the m-cache is within its maximum cost again,
+// for when an item got stored before its cost was known. It returns false
+// when the eviction policy has nothing left to evict before that.
+func (c *cache) shrink() bool {
+	maxCost := c.MaxCost()
+	for maxCost > 0 && atomic.LoadInt64(&c.cost) > maxCost {
+		ek := c.policy.NowEvict()
+		if ek == "" {
+			return false
+		}
+		c.evictVictim(ek)
+	}
+	return true
 }
 
 func (c *cache) Get(k string) (interface{}, bool) {
+	if c.Closed() {
+		return nil, false
+	}
 	c.policy.PromoteIfExist(k)
-	return c.items.Get(k)
+	v, found := c.items.Get(k)
+	if !found || v.(*entry).expired(c.now()) {
+		atomic.AddUint64(&c.stats.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.stats.hits, 1)
+	e := v.(*entry)
+	c.accessed(k, e, c.now())
+	return e.value, true
+}
+
+// accessed starts the refresh of e if it's stale and slides its expiration,
+// once it has been read at the UnixNano time now.
+func (c *cache) accessed(k string, e *entry, now int64) {
+	refreshAt := e.staleAt()
+	if refreshAt > 0 && now >= refreshAt {
+		c.refresh(k, e)
+	}
+	// the expiration is loaded before the sliding so that the swap fails if
+	// Persist or ExpireAt fixed it in between
+	if expiration := e.expiresAt(); expiration > 0 {
+		if sliding := e.slides(); sliding > 0 {
+			next := now + int64(sliding)
+			if refreshAt > 0 {
+				// the entry gets stale after the sliding and keeps its grace period
+				next += int64(c.refreshGrace)
+			}
+			// the expiration job reschedules itself when it finds e alive
+			if atomic.CompareAndSwapInt64(&e.expiration, expiration, next) && refreshAt > 0 {
+				e.setStaleAt(next - int64(c.refreshGrace))
+			}
+		}
+	}
 }
 
 // Delete an item from the m-cache. Does nothing if the key is not in the m-cache.
 func (c *cache) Delete(k string) {
-	ek := c.policy.NowEvict()
-	if c.tw != nil {
-		c.tw.RemoveJob(ek)
+	if c.Closed() {
+		return
+	}
+	if c.expirer != nil {
+		c.expirer.cancel(k)
+	}
+	v, existed := c.items.Remove(k)
+	c.policy.Evict(k)
+	if existed {
+		c.removed(k, v.(*entry), Explicit, nil)
+	}
+}
+
+// Close stops the background goroutines of the m-cache and waits for the
+// running expiration jobs to return. With WithNotifyOnClose the remaining
+// items are then removed with the Flushed reason. Afterwards Set and Delete
+// do nothing, Get finds nothing and the operations returning an error return
+// ErrClosed. Close is safe to call from several goroutines, all but the
+// first call return ErrClosed. It must not be called from an OnRemoval
+// function.
+func (c *cache) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		if c.expirer != nil {
+			c.expirer.stop()
+		}
+		if c.notifyOnClose {
+			c.removeAll(Flushed)
+		}
+		err = nil
+	})
+	return err
+}
+
+// Closed tells whether Close has been called.
+func (c *cache) Closed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// removeAll removes every item for the given reason.
+func (c *cache) removeAll(reason RemovalReason) {
+	var keys []string
+	c.items.ForEach(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	for _, k := range keys {
+		v, existed := c.items.Remove(k)
+		c.policy.Evict(k)
+		if existed {
+			c.removed(k, v.(*entry), reason, nil)
+		}
 	}
-	if v, existed := c.items.Remove(k); existed && c.onEvicted != nil {
-		go c.onEvicted(k, v)
+}
+
+// Len returns the number of items in the m-cache.
+func (c *cache) Len() int {
+	return c.items.Len()
+}
+
+// Capacity returns the maximum number of items allowed by the eviction policy.
+func (c *cache) Capacity() int64 {
+	return c.policy.Capacity()
+}
+
+// PendingExpirations returns the number of expiration jobs waiting in the time wheel.
+func (c *cache) PendingExpirations() int {
+	if c.expirer == nil {
+		return 0
 	}
+	return c.expirer.pending()
+}
+
+// Cost returns the total cost of the items in the m-cache.
+func (c *cache) Cost() int64 {
+	return atomic.LoadInt64(&c.cost)
+}
+
+// MaxCost returns the maximum cost of the m-cache, 0 means no limit.
+func (c *cache) MaxCost() int64 {
+	return atomic.LoadInt64(&c.maxCost)
 }
 
-func (c *cache) OnEvicted(onEvicted func(string, interface{})) {
-	c.onEvicted = onEvicted
+// SetMaxCost changes the maximum cost of the m-cache, items are evicted on
+// the next writes if it's exceeded.
+func (c *cache) SetMaxCost(maxCost int64) {
+	atomic.StoreInt64(&c.maxCost, maxCost)
 }
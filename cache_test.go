@@ -1,12 +1,20 @@
 package m_cache
 
 import (
+	"bytes"
 	"container/list"
+	"context"
+	"errors"
+	"m_cache/clock"
 	"m_cache/dict"
 	"m_cache/policies"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -67,19 +75,40 @@ func TestCache(t *testing.T) {
 func TestCacheTimes(t *testing.T) {
 	var found bool
 
-	tc := New(500*time.Millisecond, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewNon())
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(500*time.Millisecond, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewNon(), WithClock(clk))
+	defer tc.Close()
+	expired := make(chan string, 10)
+	tc.OnRemoval(func(e RemovalEvent) {
+		expired <- e.Key
+	})
+	// the expiration jobs run on their own goroutines once the time wheel
+	// ticks, so the removals are awaited
+	expect := func(key string) {
+		t.Helper()
+		select {
+		case k := <-expired:
+			if k != key {
+				t.Error("unexpected expiration of", k)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected expiration of", key)
+		}
+	}
 	tc.Set("a", 1, DefaultExpiration)
 	tc.Set("b", 2, NoExpiration)
 	tc.Set("c", 3, 200*time.Millisecond)
 	tc.Set("d", 4, 700*time.Millisecond)
 
-	<-time.After(250 * time.Millisecond)
+	clk.Advance(200 * time.Millisecond)
+	expect("c")
 	_, found = tc.Get("c")
 	if found {
 		t.Error("Found c when it should have been automatically deleted")
 	}
 
-	<-time.After(300 * time.Millisecond)
+	clk.Advance(300 * time.Millisecond)
+	expect("a")
 	_, found = tc.Get("a")
 	if found {
 		t.Error("Found a when it should have been automatically deleted")
@@ -95,13 +124,339 @@ func TestCacheTimes(t *testing.T) {
 		t.Error("Did not find d even though it was set to expire later than the default")
 	}
 
-	<-time.After(200 * time.Millisecond)
+	clk.Advance(200 * time.Millisecond)
+	expect("d")
 	_, found = tc.Get("d")
 	if found {
 		t.Error("Found d when it should have been automatically deleted (later than the default)")
 	}
 }
 
+func TestLazyExpiration(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	// a long cleanup interval, reads must not wait for the time wheel
+	tc := New(DefaultExpiration, time.Hour, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	tc.Set("a", 1, time.Second)
+	tc.Set("b", 2, time.Second)
+	tc.Set("c", 3, time.Second)
+	clk.Advance(time.Second)
+
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a which has expired")
+	}
+	if err := tc.Add("b", 4, NoExpiration); err != nil {
+		t.Error("Add should succeed over an expired item:", err)
+	}
+	if v, found := tc.Get("b"); !found || v != 4 {
+		t.Error("b was not added:", v)
+	}
+	if err := tc.Replace("c", 5, NoExpiration); err == nil {
+		t.Error("Replace should fail on an expired item")
+	}
+	var buf bytes.Buffer
+	if err := tc.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10))
+	if err := lc.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lc.Len() != 1 {
+		t.Error("expired items should not be saved, loaded", lc.Len())
+	}
+}
+
+func TestReclaimExpired(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(DefaultExpiration, time.Hour, dict.MakeShardDict(16), policies.NewLRU(3), WithClock(clk))
+	var reasons []string
+	tc.OnRemoval(func(e RemovalEvent) {
+		reasons = append(reasons, e.Key+" "+e.Reason.String())
+	})
+	tc.Set("a", 1, NoExpiration)
+	tc.Set("b", 2, time.Second)
+	tc.Set("c", 3, NoExpiration)
+	clk.Advance(time.Second)
+	// a is the least recently used, but b has expired
+	tc.Set("d", 4, NoExpiration)
+	if _, found := tc.Get("a"); !found {
+		t.Error("a was evicted while b had expired")
+	}
+	tc.Delete("d")
+	tc.SetMulti(map[string]interface{}{"e": 5}, time.Second)
+	clk.Advance(time.Second)
+	tc.SetMulti(map[string]interface{}{"f": 6}, NoExpiration)
+	if _, found := tc.Get("c"); !found {
+		t.Error("c was evicted while e had expired")
+	}
+	if !reflect.DeepEqual(reasons, []string{"b expired", "d explicit", "e expired"}) {
+		t.Error("unexpected removals:", reasons)
+	}
+}
+
+func TestSampledExpiration(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(DefaultExpiration, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(1000),
+		WithClock(clk), WithSampledExpiration(0, 0))
+	for i := 0; i < 500; i++ {
+		tc.Set("e"+strconv.Itoa(i), i, time.Second)
+	}
+	for i := 0; i < 10; i++ {
+		tc.Set("p"+strconv.Itoa(i), i, NoExpiration)
+	}
+	if tc.PendingExpirations() != 0 {
+		t.Error("sampled expiration should keep no job")
+	}
+	clk.Advance(time.Second)
+	// a tick is only received once the cycle of the previous one is done
+	for i := 0; i < 5; i++ {
+		clk.Advance(100 * time.Millisecond)
+	}
+	if n := tc.Len(); n > 100 {
+		t.Error("expected most expired items to be removed, left", n)
+	}
+	for i := 0; i < 10; i++ {
+		if _, found := tc.Get("p" + strconv.Itoa(i)); !found {
+			t.Error("Did not find an item set to never expire", i)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(DefaultExpiration, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	expired := make(chan string, 10)
+	tc.OnRemoval(func(e RemovalEvent) {
+		expired <- e.Key
+	})
+	tc.Set("a", 1, time.Second)
+	tc.Set("b", 2, time.Second)
+	tc.Set("c", 3, NoExpiration)
+	tc.Set("d", 4, time.Second)
+
+	if d, found := tc.TTL("a"); !found || d != time.Second {
+		t.Error("unexpected TTL of a:", d, found)
+	}
+	if d, found := tc.TTL("c"); !found || d != NoExpiration {
+		t.Error("unexpected TTL of c:", d, found)
+	}
+	if _, found := tc.TTL("z"); found {
+		t.Error("found TTL of a missing key")
+	}
+
+	if err := tc.Touch("a", 3*time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := tc.Persist("b"); err != nil {
+		t.Error(err)
+	}
+	if err := tc.ExpireAt("c", clk.Now().Add(2*time.Second)); err != nil {
+		t.Error(err)
+	}
+	if err := tc.ExpireAt("d", clk.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := tc.Touch("z", time.Second); err == nil {
+		t.Error("Touch should fail on a missing key")
+	}
+	if k := <-expired; k != "d" {
+		t.Error("expected d to expire right away, got", k)
+	}
+
+	// the jobs added at Set time must not remove a and b
+	clk.Advance(1500 * time.Millisecond)
+	clk.Advance(100 * time.Millisecond)
+	for _, k := range []string{"a", "b", "c"} {
+		if _, found := tc.Get(k); !found {
+			t.Error("Did not find", k, "whose TTL was changed")
+		}
+	}
+	clk.Advance(600 * time.Millisecond)
+	select {
+	case k := <-expired:
+		if k != "c" {
+			t.Error("expected c to expire, got", k)
+		}
+	case <-time.After(time.Second):
+		t.Error("c did not expire")
+	}
+	clk.Advance(time.Second)
+	select {
+	case k := <-expired:
+		if k != "a" {
+			t.Error("expected a to expire, got", k)
+		}
+	case <-time.After(time.Second):
+		t.Error("a did not expire")
+	}
+	if d, found := tc.TTL("b"); !found || d != NoExpiration {
+		t.Error("b should have been persisted:", d, found)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(DefaultExpiration, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(10),
+		WithClock(clk), WithSlidingExpiration())
+	tc.Set("a", 1, time.Second)
+	tc.Set("b", 2, time.Second)
+	for i := 0; i < 5; i++ {
+		clk.Advance(600 * time.Millisecond)
+		if _, found := tc.Get("a"); !found {
+			t.Fatal("a expired while it was read", i)
+		}
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("Found b which wasn't read")
+	}
+
+	clk.Advance(time.Second)
+	clk.Advance(100 * time.Millisecond)
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a which wasn't read for a second")
+	}
+
+	tc = New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	tc.Set("a", 1, time.Second)
+	tc.SetSliding("b", 2, time.Second)
+	clk.Advance(600 * time.Millisecond)
+	tc.Get("a")
+	tc.Get("b")
+	clk.Advance(600 * time.Millisecond)
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a whose expiration doesn't slide")
+	}
+	if _, found := tc.Get("b"); !found {
+		t.Error("Did not find b whose expiration slides")
+	}
+}
+
+func TestSlidingPersistExpireAt(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	tc.SetSliding("a", 1, time.Second)
+	if err := tc.Persist("a"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Get("a")
+	if ttl, _ := tc.TTL("a"); ttl != NoExpiration {
+		t.Error("a slid after Persist, its TTL is", ttl)
+	}
+	clk.Advance(2 * time.Second)
+	if _, found := tc.Get("a"); !found {
+		t.Error("Did not find a which was persisted")
+	}
+
+	tc.SetSliding("b", 2, time.Second)
+	if err := tc.ExpireAt("b", clk.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(600 * time.Millisecond)
+	tc.Get("b")
+	clk.Advance(600 * time.Millisecond)
+	if _, found := tc.Get("b"); found {
+		t.Error("Found b which slid after ExpireAt")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, k string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if k == "broken" {
+			return nil, 0, errors.New("failed")
+		}
+		return "v2", time.Second, nil
+	}
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10),
+		WithClock(clk), WithRefresh(loader, time.Second))
+	tc.Set("a", "v1", time.Second)
+	tc.Set("broken", "v1", time.Second)
+
+	clk.Advance(time.Second)
+	for i := 0; i < 10; i++ {
+		if v, found := tc.Get("a"); !found || v != "v1" {
+			t.Error("expected the stale value, got", v)
+		}
+	}
+	tc.Get("broken")
+	close(release)
+	deadline := time.After(time.Second)
+	for {
+		if v, _ := tc.Get("a"); v == "v2" {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("a was not refreshed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Error("expected a single reload per key, loader called", n)
+	}
+
+	clk.Advance(time.Second)
+	if _, found := tc.Get("broken"); found {
+		t.Error("Found broken after its grace period")
+	}
+	if d, found := tc.TTL("a"); !found || d != time.Second {
+		t.Error("expected a to be fresh again, TTL", d)
+	}
+}
+
+func TestRefreshExpiration(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	var calls int32
+	loader := func(ctx context.Context, k string) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return "v2", time.Second, nil
+	}
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10),
+		WithClock(clk), WithRefresh(loader, time.Second))
+	tc.SetSliding("a", "v1", time.Second)
+	tc.Set("b", "v1", time.Second)
+	tc.Set("c", "v1", time.Second)
+	for i := 0; i < 3; i++ {
+		clk.Advance(600 * time.Millisecond)
+		tc.Get("a")
+	}
+	if d, _ := tc.TTL("a"); d != 2*time.Second {
+		t.Error("the grace period of a did not slide, TTL", d)
+	}
+	if err := tc.Persist("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.ExpireAt("c", clk.Now().Add(3*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	tc.Get("b")
+	tc.Get("c")
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Error("fresh items were reloaded, loader called", n)
+	}
+
+	var buf bytes.Buffer
+	clk.Advance(1500 * time.Millisecond)
+	if err := tc.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	if err := lc.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// a is stale but still in its grace period
+	if d, found := lc.TTL("a"); !found || d != 500*time.Millisecond {
+		t.Error("a was not saved until the end of its grace period, TTL", d, found)
+	}
+	if d, found := lc.TTL("c"); !found || d != 1500*time.Millisecond {
+		t.Error("unexpected TTL of c", d, found)
+	}
+}
+
 func TestCacheEviction(t *testing.T) {
 	var found bool
 	tc := New(500*time.Millisecond, 100*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(3))
@@ -121,6 +476,757 @@ func TestCacheEviction(t *testing.T) {
 	}
 }
 
+func TestCacheAdmission(t *testing.T) {
+	// a capacity of 1 has no window, so a cold key is refused right away
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewWTinyLFU(1))
+	tc.Set("a", 1, NoExpiration)
+	tc.Get("a")
+	if err := tc.Add("c", 3, NoExpiration); err == nil {
+		t.Error("c should not be admitted")
+	}
+	if _, found := tc.Get("c"); found {
+		t.Error("Found c which shouldn't be admitted")
+	}
+	if _, found := tc.Get("a"); !found {
+		t.Error("a was evicted for a refused key")
+	}
+}
+
+func TestCacheWithARC(t *testing.T) {
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewARC(100))
+	for i := 0; i < 50; i++ {
+		tc.Set("hot"+strconv.Itoa(i), i, NoExpiration)
+		tc.Get("hot" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		tc.Set("scan"+strconv.Itoa(i), i, NoExpiration)
+	}
+	for i := 0; i < 50; i++ {
+		if _, found := tc.Get("hot" + strconv.Itoa(i)); !found {
+			t.Error("hot key was evicted by the scan:", i)
+		}
+	}
+}
+
+func TestCacheCost(t *testing.T) {
+	sizer := func(k string, v interface{}) int64 {
+		return int64(len(v.(string)))
+	}
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(100), WithSizer(sizer), WithMaxCost(10))
+	tc.Set("a", "aaaa", NoExpiration)
+	tc.Set("b", "bbbb", NoExpiration)
+	if tc.Cost() != 8 {
+		t.Error("expected cost 8, got", tc.Cost())
+	}
+	tc.Set("c", "cccc", NoExpiration)
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a when it should have been evicted to fit c")
+	}
+	if tc.Cost() != 8 {
+		t.Error("expected cost 8, got", tc.Cost())
+	}
+	tc.Set("b", "b", NoExpiration)
+	if tc.Cost() != 5 {
+		t.Error("expected cost 5 after replacing b, got", tc.Cost())
+	}
+	tc.SetWithCost("d", "d", 9, NoExpiration)
+	if _, found := tc.Get("c"); found {
+		t.Error("Found c when it should have been evicted to fit d")
+	}
+	if tc.Cost() != 10 || tc.MaxCost() != 10 {
+		t.Error("expected cost 10 of 10, got", tc.Cost(), tc.MaxCost())
+	}
+	tc.SetWithCost("e", "e", 11, NoExpiration)
+	if _, found := tc.Get("e"); found {
+		t.Error("Found e which costs more than the whole cache")
+	}
+	tc.Delete("d")
+	if tc.Cost() != 1 {
+		t.Error("expected cost 1 after deleting d, got", tc.Cost())
+	}
+
+	// a failed Add doesn't evict anything
+	tc.Set("a", "aaaaa", NoExpiration)
+	tc.Set("f", "fffff", NoExpiration)
+	if err := tc.Add("f", "ffffffff", NoExpiration); err == nil {
+		t.Error("Add should fail on an existing key")
+	}
+	if _, found := tc.Get("a"); !found || tc.Len() != 2 {
+		t.Error("a failed Add shouldn't evict a, got", tc.Len(), "items")
+	}
+}
+
+func TestCacheCostNothingToEvict(t *testing.T) {
+	sizer := func(k string, v interface{}) int64 {
+		return int64(len(v.(string)))
+	}
+	// the Non policy never evicts, so the maximum cost can't be met by evicting
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewNon(), WithSizer(sizer), WithMaxCost(10))
+	tc.Set("a", "aaaaaa", NoExpiration)
+	tc.Set("b", "bbbbbb", NoExpiration)
+	if err := tc.Add("c", "cccccc", NoExpiration); err == nil {
+		t.Error("c should not fit")
+	}
+	tc.SetMulti(map[string]interface{}{"d": "dd", "e": "eeeeee"}, NoExpiration)
+	if _, found := tc.Get("e"); found {
+		t.Error("Found e which doesn't fit")
+	}
+	if _, ok := tc.Compute("f", func(old interface{}, exists bool) (interface{}, bool) {
+		return "ffffff", true
+	}, NoExpiration); ok {
+		t.Error("Compute stored f which doesn't fit")
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("Found b which doesn't fit")
+	}
+	if tc.Cost() > tc.MaxCost() {
+		t.Error("expected the cost to stay within", tc.MaxCost(), "got", tc.Cost())
+	}
+}
+
+func TestMulti(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	var replaced, deleted, evicted int
+	tc := New(DefaultExpiration, time.Second, dict.MakeShardDict(16), policies.NewLRU(5), WithClock(clk))
+	defer tc.Close()
+	tc.OnRemoval(func(e RemovalEvent) {
+		switch e.Reason {
+		case Replaced:
+			replaced++
+		case Explicit:
+			deleted++
+		case Capacity:
+			evicted++
+		}
+	})
+
+	tc.SetMulti(map[string]interface{}{"a": 1, "b": 2, "c": 3}, time.Minute)
+	found := tc.GetMulti([]string{"a", "b", "c", "d"})
+	if len(found) != 3 || found["a"] != 1 || found["b"] != 2 || found["c"] != 3 {
+		t.Error("unexpected values:", found)
+	}
+	if ttl, _ := tc.TTL("b"); ttl != time.Minute {
+		t.Error("unexpected TTL:", ttl)
+	}
+	if s := tc.Stats(); s.Hits != 3 || s.Misses != 1 || s.Sets != 3 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	tc.SetMulti(map[string]interface{}{"c": 30, "d": 4, "e": 5, "f": 6, "g": 7}, NoExpiration)
+	if tc.Len() != 5 || evicted != 2 || replaced != 1 {
+		t.Error("expected 2 evictions and 1 replacement, got", evicted, replaced, "for", tc.Len(), "items")
+	}
+	if tc.Cost() != 5 {
+		t.Error("expected cost 5, got", tc.Cost())
+	}
+	if x, _ := tc.Get("c"); x != 30 {
+		t.Error("c should have been replaced:", x)
+	}
+	if ttl, _ := tc.TTL("c"); ttl != NoExpiration {
+		t.Error("c shouldn't expire anymore:", ttl)
+	}
+
+	tc.DeleteMulti([]string{"d", "e", "z", "d"})
+	if tc.Len() != 3 || deleted != 2 || tc.Cost() != 3 {
+		t.Error("expected 2 deletions, got", deleted, "with", tc.Len(), "items of cost", tc.Cost())
+	}
+	if found := tc.GetMulti([]string{"d", "e"}); len(found) != 0 {
+		t.Error("deleted items were found:", found)
+	}
+}
+
+func TestMultiCost(t *testing.T) {
+	sizer := func(k string, v interface{}) int64 {
+		return int64(len(v.(string)))
+	}
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(100), WithSizer(sizer), WithMaxCost(10))
+	tc.Set("a", "aaaa", NoExpiration)
+	tc.SetMulti(map[string]interface{}{"b": "bbbb", "c": "cccc", "d": "dddddddddddd"}, NoExpiration)
+	if tc.Cost() != 8 || tc.Len() != 2 {
+		t.Error("expected 2 items of cost 8, got", tc.Len(), tc.Cost())
+	}
+	if found := tc.GetMulti([]string{"a", "b", "c", "d"}); found["b"] == nil || found["c"] == nil {
+		t.Error("expected b and c to fit by evicting a:", found)
+	}
+}
+
+func TestRange(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	tc.Set("a", 1, NoExpiration)
+	tc.Set("b", 2, time.Minute)
+	tc.Set("c", 3, time.Second)
+	clk.Advance(2 * time.Second)
+
+	keys := tc.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Error("unexpected keys:", keys)
+	}
+	if tc.Count() != 2 || tc.Len() != 3 {
+		t.Error("expected 2 items counted out of 3 stored, got", tc.Count(), tc.Len())
+	}
+	items := tc.Items()
+	if len(items) != 2 || items["a"].Object != 1 || items["a"].Expiration != 0 {
+		t.Error("unexpected items:", items)
+	}
+	if b := items["b"]; b.Object != 2 || b.Expiration != clk.Now().Add(58*time.Second).UnixNano() || b.Expired(clk.Now()) {
+		t.Error("unexpected item b:", b)
+	}
+	n := 0
+	tc.Range(func(k string, x interface{}) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Error("Range should stop when fn returns false, got", n, "calls")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	lru := policies.NewLRU(1000)
+	tc := New(DefaultExpiration, time.Second, dict.MakeShardDict(16), lru)
+	defer tc.Close()
+	var flushed int64
+	tc.OnRemoval(func(e RemovalEvent) {
+		if e.Reason == Flushed {
+			atomic.AddInt64(&flushed, 1)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Hour)
+	}
+	tc.Flush()
+	if tc.Len() != 0 || tc.Cost() != 0 || len(lru.Keys()) != 0 || flushed != 100 {
+		t.Error("expected an empty m-cache and 100 flushed items, got", tc.Len(), tc.Cost(), len(lru.Keys()), flushed)
+	}
+	for i := 0; i < 100 && tc.PendingExpirations() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if tc.PendingExpirations() != 0 {
+		t.Error("expected no pending expiration, got", tc.PendingExpirations())
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tc.Set(strconv.Itoa(w*1000+i), i, time.Hour)
+			}
+		}(w)
+	}
+	for i := 0; i < 10; i++ {
+		tc.Flush()
+	}
+	wg.Wait()
+	if n := tc.Len(); int64(n) != tc.Cost() || n != len(lru.Keys()) {
+		t.Error("dict, cost and policy disagree after concurrent flushes:", n, tc.Cost(), len(lru.Keys()))
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	var replaced, deleted int
+	tc.OnRemoval(func(e RemovalEvent) {
+		switch e.Reason {
+		case Replaced:
+			replaced++
+		case Explicit:
+			deleted++
+		}
+	})
+	tc.Set("config", "v1", NoExpiration)
+	x, version, found := tc.GetWithVersion("config")
+	if !found || x != "v1" {
+		t.Fatal("unexpected value:", x)
+	}
+	tc.Set("config", "v2", NoExpiration)
+	if tc.CompareAndSwap("config", version, "v3", NoExpiration) {
+		t.Error("swapped with a stale version")
+	}
+	_, version, _ = tc.GetWithVersion("config")
+	if !tc.CompareAndSwap("config", version, "v3", time.Minute) || replaced != 2 {
+		t.Error("didn't swap with the current version")
+	}
+	if x, _ := tc.Get("config"); x != "v3" {
+		t.Error("unexpected value after a swap:", x)
+	}
+	if ttl, _ := tc.TTL("config"); ttl != time.Minute {
+		t.Error("the swapped item should expire in a minute:", ttl)
+	}
+	if tc.CompareAndDelete("config", version) {
+		t.Error("deleted with a stale version")
+	}
+	_, version, _ = tc.GetWithVersion("config")
+	if !tc.CompareAndDelete("config", version) || deleted != 1 || tc.Len() != 0 {
+		t.Error("didn't delete with the current version")
+	}
+	if tc.CompareAndSwap("config", version, "v4", NoExpiration) {
+		t.Error("swapped a deleted item")
+	}
+
+	tc.Set("short", 1, time.Second)
+	clk.Advance(2 * time.Second)
+	if _, _, found := tc.GetWithVersion("short"); found {
+		t.Error("found an expired item")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	reasons := make(map[RemovalReason]int)
+	var mu sync.Mutex
+	tc.OnRemoval(func(e RemovalEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[e.Reason]++
+	})
+	add := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				tc.Compute("counter", add, time.Minute)
+			}
+		}()
+	}
+	wg.Wait()
+	if x, _ := tc.Get("counter"); x != 400 || reasons[Replaced] != 399 {
+		t.Error("lost updates:", x, reasons[Replaced])
+	}
+	if ttl, _ := tc.TTL("counter"); ttl != time.Minute {
+		t.Error("computed item should expire in a minute:", ttl)
+	}
+
+	clk.Advance(2 * time.Minute)
+	if x, found := tc.Compute("counter", add, NoExpiration); !found || x != 1 || reasons[Expired] != 1 {
+		t.Error("an expired item should be passed as missing:", x, reasons[Expired])
+	}
+	if x, found := tc.Compute("counter", func(old interface{}, exists bool) (interface{}, bool) {
+		return nil, false
+	}, NoExpiration); found || x != nil || tc.Len() != 0 || reasons[Explicit] != 1 {
+		t.Error("expected counter to be deleted")
+	}
+
+	concat := func(old, x interface{}) (interface{}, bool) {
+		return old.(string) + x.(string), true
+	}
+	tc.Merge("s", "a", concat, NoExpiration)
+	if x, _ := tc.Merge("s", "b", concat, NoExpiration); x != "ab" {
+		t.Error("unexpected merged value:", x)
+	}
+
+	sizer := func(k string, v interface{}) int64 {
+		return int64(len(v.(string)))
+	}
+	sized := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithSizer(sizer), WithMaxCost(4))
+	sized.Set("a", "aa", NoExpiration)
+	sized.Merge("b", "b", concat, NoExpiration)
+	sized.Merge("b", "bb", concat, NoExpiration)
+	if _, found := sized.Get("a"); found || sized.Cost() != 3 {
+		t.Error("a should have been evicted when b grew, cost is", sized.Cost())
+	}
+	sized.Set("c", "c", NoExpiration)
+	if x, found := sized.Merge("b", "bb", concat, NoExpiration); found || x != nil {
+		t.Error("b costs more than the whole cache once merged:", x)
+	}
+	if x, _ := sized.Get("b"); x != "bbb" || sized.Cost() != 4 {
+		t.Error("an oversized value should leave b unchanged:", x, sized.Cost())
+	}
+	if _, found := sized.Get("c"); !found {
+		t.Error("c was evicted for an oversized value")
+	}
+}
+
+func TestTags(t *testing.T) {
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(4))
+	var invalidated []string
+	tc.OnRemoval(func(e RemovalEvent) {
+		if e.Reason == Explicit {
+			invalidated = append(invalidated, e.Key)
+		}
+	})
+	tc.SetWithTags("a", 1, NoExpiration, "product:1", "product:2")
+	tc.SetWithTags("b", 2, NoExpiration, "product:1", "product:1")
+	tc.SetWithTags("c", 3, NoExpiration, "product:2")
+	tc.Set("d", 4, NoExpiration)
+	if tags, _ := tc.Tags("b"); !reflect.DeepEqual(tags, []string{"product:1"}) {
+		t.Error("unexpected tags of b:", tags)
+	}
+	if n := tc.InvalidateTag("product:1"); n != 2 || tc.Len() != 2 {
+		t.Error("expected a and b to be invalidated, got", n, "with", tc.Len(), "items left")
+	}
+	sort.Strings(invalidated)
+	if !reflect.DeepEqual(invalidated, []string{"a", "b"}) {
+		t.Error("unexpected invalidated keys:", invalidated)
+	}
+	if n := tc.InvalidateTag("product:1"); n != 0 {
+		t.Error("nothing should be left to invalidate, got", n)
+	}
+
+	// setting an item again without tags untags it
+	tc.SetWithTags("c", 30, NoExpiration)
+	if n := tc.InvalidateTag("product:2"); n != 0 {
+		t.Error("c shouldn't carry product:2 anymore")
+	}
+	// in-place updates keep the tags
+	tc.SetWithTags("n", 1, NoExpiration, "counters")
+	tc.Increment("n", 1)
+	if n := tc.InvalidateTag("counters"); n != 1 {
+		t.Error("expected n to be invalidated, got", n)
+	}
+	tc.SetWithTags("x", 1, NoExpiration, "kept")
+	tc.SetWithTags("y", 1, NoExpiration, "kept")
+	tc.SetWithTags("z", 1, NoExpiration, "kept")
+	tc.Compute("x", func(old interface{}, exists bool) (interface{}, bool) {
+		return old.(int) + 1, true
+	}, NoExpiration)
+	if _, version, _ := tc.GetWithVersion("y"); !tc.CompareAndSwap("y", version, 2, NoExpiration) {
+		t.Error("y should have been swapped")
+	}
+	if err := tc.Replace("z", 2, NoExpiration); err != nil {
+		t.Error(err)
+	}
+	for _, k := range []string{"x", "y", "z"} {
+		if tags, _ := tc.Tags(k); !reflect.DeepEqual(tags, []string{"kept"}) {
+			t.Error("the tags of", k, "were not kept:", tags)
+		}
+	}
+	if n := tc.InvalidateTag("kept"); n != 3 {
+		t.Error("expected x, y and z to be invalidated, got", n)
+	}
+
+	// the index follows evictions and deletes
+	for i := 0; i < 10; i++ {
+		tc.SetWithTags(strconv.Itoa(i), i, NoExpiration, "bulk")
+	}
+	if n := len(tc.tags.tagged("bulk")); n != 4 || tc.Len() != 4 {
+		t.Error("evicted items should be unindexed, got", n, "indexed for", tc.Len(), "items")
+	}
+	tc.Delete("9")
+	if n := len(tc.tags.tagged("bulk")); n != 3 || tc.Len() != 3 {
+		t.Error("deleted items should be unindexed, got", n, "indexed for", tc.Len(), "items")
+	}
+
+	var buf bytes.Buffer
+	if err := tc.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(4))
+	if err := restored.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.InvalidateTag("bulk"); n != 3 {
+		t.Error("tags should be restored, got", n, "invalidated items")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(2))
+	tc.Set("a", 1, NoExpiration)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, NoExpiration)
+	tc.Get("a")
+	tc.Get("b")
+	tc.Add("b", 2, NoExpiration)
+	tc.Replace("z", 2, NoExpiration)
+	tc.Delete("c")
+	tc.GetOrLoad(context.Background(), "d", func(ctx context.Context) (interface{}, time.Duration, error) {
+		return nil, 0, errors.New("failed")
+	})
+
+	s := tc.Stats()
+	expected := Stats{Hits: 1, Misses: 2, Sets: 3, AddsFailed: 1, ReplacesFailed: 1, Deletes: 1, Evictions: 1, LoaderCalls: 1, LoaderErrors: 1}
+	if s != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, s)
+	}
+	tc.ResetStats()
+	if s = tc.Stats(); s != (Stats{}) {
+		t.Errorf("expected stats to be reset, got %+v", s)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		tc := New(DefaultExpiration, 10*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(3), WithCodec(codec))
+		tc.Set("a", "a", NoExpiration)
+		tc.Set("b", "b", 100*time.Millisecond)
+		tc.Set("c", "c", NoExpiration)
+		tc.Get("a")
+
+		path := t.TempDir() + "/snapshot"
+		if err := tc.SaveFile(path); err != nil {
+			t.Fatal(err)
+		}
+
+		lc := New(DefaultExpiration, 10*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(3), WithCodec(codec))
+		if err := lc.LoadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			if v, found := lc.items.Get(k); !found || v.(*entry).value != k {
+				t.Errorf("%T: %s was not restored", codec, k)
+			}
+		}
+		// b was the least recently used, a the most
+		lc.Set("d", "d", NoExpiration)
+		if _, found := lc.items.Get("b"); found {
+			t.Errorf("%T: recency order was not restored", codec)
+		}
+
+		lc = New(DefaultExpiration, 10*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(3), WithCodec(codec))
+		if err := lc.LoadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		<-time.After(150 * time.Millisecond)
+		if _, found := lc.Get("b"); found {
+			t.Errorf("%T: b should have expired after being loaded", codec)
+		}
+		if _, found := lc.Get("a"); !found {
+			t.Errorf("%T: a should never expire", codec)
+		}
+	}
+}
+
+func TestOnRemoval(t *testing.T) {
+	tc := New(DefaultExpiration, 10*time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(2))
+	var mu sync.Mutex
+	events := make(map[string]RemovalEvent)
+	tc.OnRemoval(func(e RemovalEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[e.Key] = e
+	})
+	tc.Set("a", 1, NoExpiration)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("b", 3, NoExpiration)
+	tc.Set("c", 4, 30*time.Millisecond)
+	tc.Delete("b")
+	<-time.After(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]RemovalEvent{
+		"a": {Key: "a", Value: 1, Reason: Capacity},
+		"b": {Key: "b", Value: 3, Reason: Explicit},
+		"c": {Key: "c", Value: 4, Reason: Expired},
+	}
+	for k, exp := range expected {
+		e := events[k]
+		e.Time = time.Time{}
+		if e != exp {
+			t.Errorf("expected event %+v, got %+v", exp, e)
+		}
+	}
+
+	var replaced RemovalEvent
+	tc.OnRemoval(func(e RemovalEvent) {
+		replaced = e
+	})
+	tc.Set("d", 5, NoExpiration)
+	tc.Replace("d", 6, NoExpiration)
+	if replaced.Reason != Replaced || replaced.Value != 5 || replaced.NewValue != 6 {
+		t.Errorf("unexpected replace event %+v", replaced)
+	}
+}
+
+func TestClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	for _, engine := range []ExpirationEngine{TimeWheelExpiration, SampledExpiration} {
+		tc := New(DefaultExpiration, time.Millisecond, dict.MakeShardDict(16), policies.NewLRU(10),
+			WithExpirationEngine(engine), WithNotifyOnClose())
+		var flushed int32
+		tc.OnRemoval(func(e RemovalEvent) {
+			if e.Reason == Flushed {
+				atomic.AddInt32(&flushed, 1)
+			}
+		})
+		tc.Set("a", 1, time.Minute)
+		tc.Set("b", 2, NoExpiration)
+
+		wg := sync.WaitGroup{}
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- tc.Close()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		var succeeded int
+		for err := range errs {
+			if err == nil {
+				succeeded++
+			} else if err != ErrClosed {
+				t.Error("unexpected error", err)
+			}
+		}
+		if succeeded != 1 || !tc.Closed() {
+			t.Error("expected exactly one Close to succeed, got", succeeded)
+		}
+		if n := atomic.LoadInt32(&flushed); n != 2 {
+			t.Error("expected 2 flushed items, got", n)
+		}
+		if err := tc.Add("c", 3, NoExpiration); err != ErrClosed {
+			t.Error("expected ErrClosed, got", err)
+		}
+		tc.Set("c", 3, time.Minute)
+		if _, found := tc.Get("c"); found {
+			t.Error("Found c set after Close")
+		}
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("goroutines leaked, %d running instead of %d", n, goroutines)
+	}
+}
+
+func TestTypedCache(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	c := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10))
+	points := NewTyped[point, string](c, nil)
+	points.Set(point{1, 2}, "a", NoExpiration)
+	points.Set(point{2, 1}, "b", NoExpiration)
+	if v, found := points.Get(point{1, 2}); !found || v != "a" {
+		t.Error("unexpected value for {1 2}:", v)
+	}
+	if v, found := points.Get(point{2, 1}); !found || v != "b" {
+		t.Error("unexpected value for {2 1}:", v)
+	}
+
+	ids := NewTyped[int, int](c, nil)
+	v, err := ids.GetOrLoad(context.Background(), 42, func(ctx context.Context) (int, time.Duration, error) {
+		return 84, NoExpiration, nil
+	})
+	if err != nil || v != 84 {
+		t.Error("unexpected loaded value:", v, err)
+	}
+	if x, found := c.Get("42"); !found || x != 84 {
+		t.Error("int key should be stored in base 10:", x)
+	}
+	c.Set("43", "not an int", NoExpiration)
+	if _, found := ids.Get(43); found {
+		t.Error("a value of another type should be reported missing")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	c := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10), WithClock(clk))
+	defer c.Close()
+
+	c.Set("hits", 0, NoExpiration)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Increment("hits", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if x, _ := c.Get("hits"); x != 100 {
+		t.Error("concurrent increments were lost:", x)
+	}
+
+	c.Set("small", uint8(255), NoExpiration)
+	if n, err := c.Increment("small", 1); err != nil || n != 0 {
+		t.Error("uint8 should wrap around:", n, err)
+	}
+	if x, _ := c.Get("small"); x != uint8(0) {
+		t.Errorf("stored type should be kept, got %T", x)
+	}
+	if n, err := c.Decrement("small", 1); err != nil || n != 255 {
+		t.Error("unexpected decrement:", n, err)
+	}
+	c.Set("ratio", float32(0.5), NoExpiration)
+	if f, err := c.IncrementFloat("ratio", 0.25); err != nil || f != 0.75 {
+		t.Error("unexpected float increment:", f, err)
+	}
+
+	if _, err := c.Increment("missing", 1); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+	c.Set("name", "m-cache", NoExpiration)
+	var notNumeric *NotNumericError
+	if _, err := c.Increment("name", 1); !errors.As(err, &notNumeric) || notNumeric.Key != "name" {
+		t.Error("expected a NotNumericError, got", err)
+	}
+	if _, err := c.IncrementFloat("hits", 1); !errors.As(err, &notNumeric) || err.Error() != "item hits holds a int, not a float" {
+		t.Error("an int shouldn't be incremented as a float:", err)
+	}
+	if _, err := c.Increment("ratio", 1); err == nil || err.Error() != "item ratio holds a float32, not an integer" {
+		t.Error("a float shouldn't be incremented as an integer:", err)
+	}
+
+	c.Set("hits", 1, time.Second)
+	if n, err := c.IncrementOrCreate("hits", 5, time.Minute); err != nil || n != 6 {
+		t.Error("unexpected increment of an existing item:", n, err)
+	}
+	if ttl, _ := c.TTL("hits"); ttl != time.Second {
+		t.Error("increment shouldn't change the expiration:", ttl)
+	}
+	clk.Advance(2 * time.Second)
+	if _, err := c.Increment("hits", 1); !errors.Is(err, ErrNotFound) {
+		t.Error("an expired item should be missing:", err)
+	}
+	if n, err := c.IncrementOrCreate("hits", 5, time.Minute); err != nil || n != 5 {
+		t.Error("an expired item should be recreated:", n, err)
+	}
+	if ttl, _ := c.TTL("hits"); ttl != time.Minute {
+		t.Error("created item should use the given expiration:", ttl)
+	}
+
+	c.Close()
+	if _, err := c.Increment("hits", 1); !errors.Is(err, ErrClosed) {
+		t.Error("expected ErrClosed, got", err)
+	}
+}
+
+func TestIncrementRefresh(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	loader := func(ctx context.Context, k string) (interface{}, time.Duration, error) {
+		return 0, time.Second, nil
+	}
+	c := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(10),
+		WithClock(clk), WithRefresh(loader, time.Second))
+	c.Set("hits", 1, time.Second)
+	if _, err := c.Increment("hits", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.IncrementOrCreate("created", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"hits", "created"} {
+		if v, _ := c.items.Get(k); v.(*entry).staleAt() != 0 {
+			t.Error("the counter", k, "would be overwritten by the refresh loader")
+		}
+	}
+	clk.Advance(1500 * time.Millisecond)
+	if x, _ := c.Get("hits"); x != 2 {
+		t.Error("unexpected counter:", x)
+	}
+	if x, _ := c.Get("created"); x != int64(1) {
+		t.Error("unexpected created counter:", x)
+	}
+}
+
 func TestRacing(t *testing.T) {
 	mockLru := NewMockLRU(100)
 	tc := New(500*time.Millisecond, 100*time.Millisecond, dict.MakeShardDict(16), mockLru)
@@ -163,6 +1269,89 @@ func TestRacing(t *testing.T) {
 	}
 }
 
+func TestGetOrLoad(t *testing.T) {
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewNon())
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "v", NoExpiration, nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := tc.GetOrLoad(context.Background(), "a", loader)
+			if err != nil || v != "v" {
+				t.Error("GetOrLoad returned unexpected result:", v, err)
+			}
+		}()
+	}
+	<-time.After(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("loader should be called once, called", n)
+	}
+	if v, found := tc.Get("a"); !found || v != "v" {
+		t.Error("loaded value was not stored:", v)
+	}
+}
+
+func TestGetOrLoadError(t *testing.T) {
+	errLoad := errors.New("load failed")
+	var calls int32
+	loader := func(ctx context.Context) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, 0, errLoad
+	}
+
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewNon())
+	for i := 0; i < 2; i++ {
+		if _, err := tc.GetOrLoad(context.Background(), "a", loader); err != errLoad {
+			t.Error("expected loader error, got", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Error("errors should not be cached by default, loader called", n)
+	}
+
+	calls = 0
+	tc = New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewNon(), WithLoaderErrorExpiration(time.Minute))
+	for i := 0; i < 2; i++ {
+		if _, err := tc.GetOrLoad(context.Background(), "a", loader); err != errLoad {
+			t.Error("expected loader error, got", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("error should be cached, loader called", n)
+	}
+}
+
+func TestGetOrLoadCancel(t *testing.T) {
+	tc := New(DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewNon())
+	canceled := make(chan struct{})
+	loader := func(ctx context.Context) (interface{}, time.Duration, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, 0, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tc.GetOrLoad(ctx, "a", loader); err != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded, got", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("loader context was not canceled after the last waiter left")
+	}
+}
+
 type MockLRU struct {
 	maxCap       int64
 	pendingQueue *list.List
@@ -0,0 +1,89 @@
+package m_cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// GetWithVersion is Get, which also returns the version of the item. The
+// version changes every time the item is written, and is meant to be given
+// to CompareAndSwap or CompareAndDelete.
+func (c *cache) GetWithVersion(k string) (interface{}, uint64, bool) {
+	if c.Closed() {
+		return nil, 0, false
+	}
+	c.policy.PromoteIfExist(k)
+	v, version, found := c.items.GetWithVersion(k)
+	now := c.now()
+	if !found || v.(*entry).expired(now) {
+		atomic.AddUint64(&c.stats.misses, 1)
+		return nil, 0, false
+	}
+	atomic.AddUint64(&c.stats.hits, 1)
+	e := v.(*entry)
+	c.accessed(k, e, now)
+	return e.value, version, true
+}
+
+// CompareAndSwap sets k like Set does, only if its version is still the
+// given one, and keeps its tags. It tells whether it did.
+func (c *cache) CompareAndSwap(k string, version uint64, x interface{}, d time.Duration) bool {
+	if c.Closed() {
+		return false
+	}
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	// no need to make room for a swap bound to fail
+	v, current, found := c.items.GetWithVersion(k)
+	if !found || current != version {
+		return false
+	}
+	cost := c.costOf(k, x)
+	if !c.makeRoom(k, cost) {
+		return false
+	}
+	e := c.newEntry(x, cost, d, c.slidingOf(d))
+	// the entry of the version is the one replaced if the swap succeeds
+	if oe := v.(*entry); !oe.expired(c.now()) {
+		e.tags = oe.tags
+	}
+	c.flushMu.RLock()
+	old, swapped := c.items.CompareAndSwap(k, version, e)
+	if !swapped {
+		c.flushMu.RUnlock()
+		return false
+	}
+	atomic.AddInt64(&c.cost, cost)
+	c.policy.Promote(k)
+	c.scheduleExpiration(k, e)
+	c.flushMu.RUnlock()
+	atomic.AddUint64(&c.stats.sets, 1)
+	if oe := old.(*entry); oe.expired(c.now()) {
+		c.removed(k, oe, Expired, nil)
+	} else {
+		c.replaced(k, oe, e)
+	}
+	return true
+}
+
+// CompareAndDelete deletes k like Delete does, only if its version is still
+// the given one. It tells whether it did.
+func (c *cache) CompareAndDelete(k string, version uint64) bool {
+	if c.Closed() {
+		return false
+	}
+	v, deleted := c.items.CompareAndDelete(k, version)
+	if !deleted {
+		return false
+	}
+	// the expiration job isn't cancelled since k may have been set again
+	// meanwhile, it finds nothing to remove otherwise
+	c.policy.Evict(k)
+	if e := v.(*entry); e.expired(c.now()) {
+		c.removed(k, e, Expired, nil)
+	} else {
+		c.removed(k, e, Explicit, nil)
+	}
+	return true
+}
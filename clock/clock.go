@@ -0,0 +1,138 @@
+// Package clock abstracts the passing of time, so that code depending on it
+// can be tested without sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock is a Clock whose time only moves forward when told to.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{
+		c:       make(chan time.Time),
+		stopped: make(chan struct{}),
+		period:  d,
+		next:    f.now.Add(d),
+		clock:   f,
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the time forward by d. Every tick due meanwhile is delivered
+// in order, and Advance doesn't return before each of them is received, so
+// the goroutine reading a ticker has seen all its ticks once Advance returns.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	f.mu.Unlock()
+	for {
+		f.mu.Lock()
+		var due *fakeTicker
+		for _, t := range f.tickers {
+			if !t.next.After(end) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			f.now = end
+			f.mu.Unlock()
+			return
+		}
+		tick := due.next
+		f.now = tick
+		due.next = tick.Add(due.period)
+		f.mu.Unlock()
+		select {
+		case due.c <- tick:
+		case <-due.stopped:
+		}
+	}
+}
+
+func (f *FakeClock) removeTicker(t *fakeTicker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, ft := range f.tickers {
+		if ft == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	c       chan time.Time
+	stopped chan struct{}
+	once    sync.Once
+	period  time.Duration
+	next    time.Time
+	clock   *FakeClock
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.once.Do(func() {
+		t.clock.removeTicker(t)
+		close(t.stopped)
+	})
+}
@@ -0,0 +1,37 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	f := NewFakeClock(start)
+	ticker := f.NewTicker(10 * time.Millisecond)
+
+	ticks := make(chan time.Time, 10)
+	go func() {
+		for tick := range ticker.C() {
+			ticks <- tick
+		}
+	}()
+
+	f.Advance(35 * time.Millisecond)
+	if now := f.Now(); !now.Equal(start.Add(35 * time.Millisecond)) {
+		t.Error("unexpected time after Advance:", now)
+	}
+	for i := 1; i <= 3; i++ {
+		if tick := <-ticks; !tick.Equal(start.Add(time.Duration(i) * 10 * time.Millisecond)) {
+			t.Error("unexpected tick:", tick)
+		}
+	}
+
+	ticker.Stop()
+	f.Advance(time.Second)
+	select {
+	case tick := <-ticks:
+		t.Error("stopped ticker ticked:", tick)
+	default:
+	}
+}
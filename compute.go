@@ -0,0 +1,110 @@
+package m_cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Compute sets k to the value returned by fn, or deletes k if fn doesn't keep
+// it, atomically: fn is called with the current value of k under the lock of
+// its shard, so it must be fast and must not use the m-cache. An expired item
+// is passed as missing. A kept value expires after d, which follows the same
+// rules as for Set, keeps the tags of the item, and is promoted by the
+// eviction policy like a set item.
+// Compute returns the value of k afterwards. When the m-cache is full and k
+// is missing, room is made first, and fn isn't called if the eviction policy
+// refuses k. A value costing more than the whole m-cache leaves k unchanged,
+// and Compute returns false if the value was evicted to make room for it.
+func (c *cache) Compute(k string, fn func(old interface{}, exists bool) (x interface{}, keep bool), d time.Duration) (interface{}, bool) {
+	if c.Closed() {
+		return nil, false
+	}
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	// the cost of the new value isn't known yet, the maximum cost is
+	// enforced once it's stored, apart from the values which can't fit
+	if !c.makeRoom(k, 0) {
+		return nil, false
+	}
+	now := c.now()
+	maxCost := c.MaxCost()
+	var old, stored *entry
+	c.flushMu.RLock()
+	c.items.Compute(k, func(v interface{}, exists bool) (interface{}, bool) {
+		old, stored = nil, nil
+		found := exists
+		var value interface{}
+		if exists {
+			old = v.(*entry)
+			if exists = !old.expired(now); exists {
+				value = old.value
+			}
+		}
+		x, keep := fn(value, exists)
+		if !keep {
+			return nil, false
+		}
+		cost := c.costOf(k, x)
+		if maxCost > 0 && cost > maxCost {
+			// the current entry stays as it is, even if it has expired
+			old = nil
+			return v, found
+		}
+		stored = c.newEntry(x, cost, d, c.slidingOf(d))
+		if exists {
+			stored.tags = old.tags
+		}
+		return stored, true
+	})
+	if stored != nil {
+		atomic.AddInt64(&c.cost, stored.cost)
+		c.policy.Promote(k)
+		c.scheduleExpiration(k, stored)
+		atomic.AddUint64(&c.stats.sets, 1)
+	} else if old != nil {
+		c.policy.Evict(k)
+	}
+	c.flushMu.RUnlock()
+	if old != nil {
+		switch {
+		case old.expired(now):
+			c.removed(k, old, Expired, nil)
+		case stored != nil:
+			c.replaced(k, old, stored)
+		default:
+			c.removed(k, old, Explicit, nil)
+		}
+	}
+	if stored == nil {
+		return nil, false
+	}
+	if !c.shrink() {
+		// nothing else is left to evict, the new value doesn't stay
+		if _, removed := c.items.RemoveIf(k, func(v interface{}) bool { return v == stored }); removed {
+			if c.expirer != nil {
+				c.expirer.cancel(k)
+			}
+			c.policy.Evict(k)
+			c.removed(k, stored, Capacity, nil)
+		}
+		return nil, false
+	}
+	// making room may have evicted k itself
+	if v, found := c.items.Get(k); !found || v != stored {
+		return nil, false
+	}
+	return stored.value, true
+}
+
+// Merge sets k to x if it's missing or expired, and otherwise to the value
+// returned by fn called with the current value and x, deleting k if fn
+// doesn't keep it. It works like Compute.
+func (c *cache) Merge(k string, x interface{}, fn func(old, x interface{}) (merged interface{}, keep bool), d time.Duration) (interface{}, bool) {
+	return c.Compute(k, func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return x, true
+		}
+		return fn(old, x)
+	}, d)
+}
@@ -176,3 +176,38 @@ func BenchmarkSyncMapMoreWrite(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkShardGetMulti reads 100 keys per operation, compare with BenchmarkShardGet100
+func BenchmarkShardGetMulti(b *testing.B) {
+	d := MakeShardDict(16)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		d.Put(keys[i], i)
+	}
+	b.ResetTimer()
+	b.SetParallelism(10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d.GetMulti(keys)
+		}
+	})
+}
+
+func BenchmarkShardGet100(b *testing.B) {
+	d := MakeShardDict(16)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		d.Put(keys[i], i)
+	}
+	b.ResetTimer()
+	b.SetParallelism(10)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, key := range keys {
+				d.Get(key)
+			}
+		}
+	})
+}
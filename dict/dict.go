@@ -11,10 +11,50 @@ type ConcurrentMap interface {
 	PutIfAbsent(key string, val interface{}) (result int)
 	// PutIfExists return 1 when key is existed (a new key added).
 	PutIfExists(key string, val interface{}) (result int)
+	// Swap puts k, v anyway and returns the previous value if any.
+	Swap(key string, val interface{}) (old interface{}, existed bool)
+	// SwapIfExists puts k, v only when key is existed and returns the previous value.
+	SwapIfExists(key string, val interface{}) (old interface{}, existed bool)
 	// Remove return 1 when an existed key removed.
 	Remove(key string) (val interface{}, existed bool)
-	// ForEach calls the recallFunc on all elements.
+	// Upsert stores the value returned by fn, called with the current value under the lock of the key.
+	// Nothing is stored if fn returns an error.
+	Upsert(key string, fn UpsertFunc) (val interface{}, err error)
+	// Compute stores the value returned by fn, called with the current value under the lock of the key, or removes
+	// the key if fn doesn't keep it. It returns the value of the key afterwards.
+	Compute(key string, fn ComputeFunc) (val interface{}, exists bool)
+	// Merge puts k, v when the key doesn't exist, or the value returned by fn called with the current value and v
+	// under the lock of the key, which is removed if fn doesn't keep it. It returns the value of the key afterwards.
+	Merge(key string, val interface{}, fn MergeFunc) (merged interface{}, exists bool)
+	// GetWithVersion returns the value of the key along with its version, every put gives the key a greater version.
+	GetWithVersion(key string) (val interface{}, version uint64, exists bool)
+	// CompareAndSwap puts k, v only when the key has the given version and returns the previous value.
+	CompareAndSwap(key string, version uint64, val interface{}) (old interface{}, swapped bool)
+	// CompareAndDelete removes the key only when it has the given version.
+	CompareAndDelete(key string, version uint64) (val interface{}, deleted bool)
+	// GetMulti returns the value of every key and whether it exists, in the order of the keys.
+	GetMulti(keys []string) (vals []interface{}, exists []bool)
+	// SwapMulti puts all the k, v and returns the previous values of the keys which existed.
+	SwapMulti(vals map[string]interface{}) (olds map[string]interface{})
+	// RemoveMulti removes the keys and returns the values of the ones which existed.
+	RemoveMulti(keys []string) (vals map[string]interface{})
+	// RemoveIf removes the key only when cond returns true for its value.
+	RemoveIf(key string, cond func(val interface{}) bool) (val interface{}, removed bool)
+	// RandomKeys returns up to limit keys picked at random, a key may be returned more than once.
+	RandomKeys(limit int) []string
+	// ForEach calls the recallFunc on all elements, until it returns false.
 	ForEach(recallFunc RecallFunc)
 }
 
+// UpsertFunc computes the new value of a key from the current one, if it exists.
+type UpsertFunc func(old interface{}, exists bool) (val interface{}, err error)
+
+// ComputeFunc computes the new value of a key from the current one, if it exists. The key is removed unless keep is
+// true.
+type ComputeFunc func(old interface{}, exists bool) (val interface{}, keep bool)
+
+// MergeFunc merges the current value of a key with a new one. The key is removed unless keep is true.
+type MergeFunc func(old, val interface{}) (merged interface{}, keep bool)
+
+// RecallFunc is called by ForEach for every element, returning false stops the iteration.
 type RecallFunc func(key string, val interface{}) bool
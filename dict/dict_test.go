@@ -0,0 +1,121 @@
+package dict
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	for name, d := range map[string]ConcurrentMap{"shard": MakeShardDict(16), "simple": MakeSimpleDict()} {
+		d.Put("k", 1)
+		_, v1, _ := d.GetWithVersion("k")
+		if _, swapped := d.CompareAndSwap("k", v1+1, 2); swapped {
+			t.Error(name, "swapped with a wrong version")
+		}
+		if old, swapped := d.CompareAndSwap("k", v1, 2); !swapped || old != 1 {
+			t.Error(name, "didn't swap with the right version:", old)
+		}
+		val, v2, _ := d.GetWithVersion("k")
+		if val != 2 || v2 <= v1 {
+			t.Error(name, "expected a greater version after a swap:", val, v1, v2)
+		}
+		if _, swapped := d.CompareAndSwap("k", v1, 3); swapped {
+			t.Error(name, "swapped with a stale version")
+		}
+
+		// a key put again doesn't get back its old version
+		d.Remove("k")
+		d.Put("k", 1)
+		if _, deleted := d.CompareAndDelete("k", v2); deleted {
+			t.Error(name, "deleted with the version of a removed value")
+		}
+		_, v3, _ := d.GetWithVersion("k")
+		if val, deleted := d.CompareAndDelete("k", v3); !deleted || val != 1 || d.Len() != 0 {
+			t.Error(name, "didn't delete with the right version:", val, d.Len())
+		}
+		if _, _, exists := d.GetWithVersion("k"); exists {
+			t.Error(name, "found a deleted key")
+		}
+	}
+}
+
+func TestVersionsAcrossShards(t *testing.T) {
+	d := MakeShardDict(16)
+	versions := make(map[uint64]string)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		d.Put(k, i)
+		_, version, _ := d.GetWithVersion(k)
+		if other, dup := versions[version]; dup {
+			t.Fatal(k, "got the version of", other)
+		}
+		versions[version] = k
+	}
+}
+
+func TestConcurrentCompareAndSwap(t *testing.T) {
+	for name, d := range map[string]ConcurrentMap{"shard": MakeShardDict(16), "simple": MakeSimpleDict()} {
+		d.Put("counter", 0)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < 100; {
+					val, version, _ := d.GetWithVersion("counter")
+					if _, swapped := d.CompareAndSwap("counter", version, val.(int)+1); swapped {
+						n++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if val, _ := d.Get("counter"); val != 800 {
+			t.Error(name, "lost increments:", val)
+		}
+	}
+}
+
+func TestCompute(t *testing.T) {
+	for name, d := range map[string]ConcurrentMap{"shard": MakeShardDict(16), "simple": MakeSimpleDict()} {
+		add := func(old interface{}, exists bool) (interface{}, bool) {
+			if !exists {
+				return 1, true
+			}
+			return old.(int) + 1, true
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < 100; n++ {
+					d.Compute("counter", add)
+				}
+			}()
+		}
+		wg.Wait()
+		if val, _ := d.Get("counter"); val != 800 || d.Len() != 1 {
+			t.Error(name, "lost updates:", val, d.Len())
+		}
+		if val, exists := d.Compute("counter", func(old interface{}, exists bool) (interface{}, bool) {
+			return nil, false
+		}); exists || val != nil || d.Len() != 0 {
+			t.Error(name, "expected the key to be removed")
+		}
+
+		concat := func(old, val interface{}) (interface{}, bool) {
+			return old.(string) + val.(string), true
+		}
+		d.Merge("s", "a", concat)
+		if merged, _ := d.Merge("s", "b", concat); merged != "ab" {
+			t.Error(name, "unexpected merged value:", merged)
+		}
+		if _, exists := d.Merge("s", "c", func(old, val interface{}) (interface{}, bool) {
+			return nil, false
+		}); exists || d.Len() != 0 {
+			t.Error(name, "expected the key to be removed by the merge")
+		}
+	}
+}
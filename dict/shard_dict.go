@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"math"
 	"math/big"
+	"math/bits"
 	insecurerand "math/rand"
 	"os"
 	"sync"
@@ -11,14 +12,22 @@ import (
 )
 
 type ShardDict struct {
-	table    []*Shard
-	count    int32
-	seed     uint32
-	hashAlgo func(seed uint32, k string) uint32
+	table []*Shard
+	// shardBits is the number of low bits of a version holding the index of its shard
+	shardBits uint
+	count     int32
+	seed      uint32
+	hashAlgo  func(seed uint32, k string) uint32
 }
 
 type Shard struct {
-	m     map[string]interface{}
+	m map[string]interface{}
+	// versions holds the version of every value of m
+	versions map[string]uint64
+	// version counts the values put in the shard, it's only accessed under the lock
+	version uint64
+	// index is the position of the shard in the table
+	index uint64
 	mutex sync.RWMutex
 }
 
@@ -44,7 +53,9 @@ func MakeShardDict(shardCount int) *ShardDict {
 	table := make([]*Shard, shardCount)
 	for i := 0; i < shardCount; i++ {
 		table[i] = &Shard{
-			m: make(map[string]interface{}),
+			m:        make(map[string]interface{}),
+			versions: make(map[string]uint64),
+			index:    uint64(i),
 		}
 	}
 	max := big.NewInt(0).SetUint64(uint64(math.MaxUint32))
@@ -57,10 +68,11 @@ func MakeShardDict(shardCount int) *ShardDict {
 		seed = uint32(rnd.Uint64())
 	}
 	d := &ShardDict{
-		count:    0,
-		table:    table,
-		seed:     seed,
-		hashAlgo: djb33,
+		count:     0,
+		table:     table,
+		shardBits: uint(bits.Len(uint(shardCount - 1))),
+		seed:      seed,
+		hashAlgo:  djb33,
 	}
 	return d
 }
@@ -117,6 +129,14 @@ func (dict *ShardDict) decreaseCount() {
 	atomic.AddInt32(&dict.count, -1)
 }
 
+// nextVersion returns a version greater than all the ones given before in the shard, so that a key removed and put
+// again never gets back a version it had. The index of the shard in the low bits keeps the versions of the shards
+// apart. It must be called under the lock of the shard.
+func (dict *ShardDict) nextVersion(shared *Shard) uint64 {
+	shared.version++
+	return shared.version<<dict.shardBits | shared.index
+}
+
 func (dict *ShardDict) Get(key string) (val interface{}, exists bool) {
 	if dict == nil {
 		panic("dict is nil")
@@ -143,19 +163,19 @@ func (dict *ShardDict) Put(key string, val interface{}) (result int) {
 
 	if _, ok := shared.m[key]; ok {
 		shared.m[key] = val
+		shared.versions[key] = dict.nextVersion(shared)
 		return 0
 	} else {
 		shared.m[key] = val
+		shared.versions[key] = dict.nextVersion(shared)
 		dict.addCount()
 		return 1
 	}
 }
 
+// Len reads the count kept by the writers, the shards can't be read without their lock
 func (dict *ShardDict) Len() (length int) {
-	for _, s := range dict.table {
-		length += len(s.m)
-	}
-	return length
+	return int(atomic.LoadInt32(&dict.count))
 }
 
 // PutIfAbsent if the key has existed, the value will not be replaced.
@@ -173,6 +193,7 @@ func (dict *ShardDict) PutIfAbsent(key string, val interface{}) (result int) {
 		return 0
 	} else {
 		shared.m[key] = val
+		shared.versions[key] = dict.nextVersion(shared)
 		dict.addCount()
 		return 1
 	}
@@ -191,12 +212,51 @@ func (dict *ShardDict) PutIfExists(key string, val interface{}) (result int) {
 
 	if _, ok := shared.m[key]; ok {
 		shared.m[key] = val
+		shared.versions[key] = dict.nextVersion(shared)
 		return 1
 	} else {
 		return 0
 	}
 }
 
+// Swap puts the value anyway and returns the one it replaced
+func (dict *ShardDict) Swap(key string, val interface{}) (old interface{}, existed bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	old, existed = shared.m[key]
+	shared.m[key] = val
+	shared.versions[key] = dict.nextVersion(shared)
+	if !existed {
+		dict.addCount()
+	}
+	return
+}
+
+// SwapIfExists the value will only be put when key has existed, the replaced one is returned
+func (dict *ShardDict) SwapIfExists(key string, val interface{}) (old interface{}, existed bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if old, existed = shared.m[key]; existed {
+		shared.m[key] = val
+		shared.versions[key] = dict.nextVersion(shared)
+	}
+	return
+}
+
 func (dict *ShardDict) Remove(key string) (val interface{}, existed bool) {
 	if dict == nil {
 		panic("dict is nil")
@@ -209,6 +269,7 @@ func (dict *ShardDict) Remove(key string) (val interface{}, existed bool) {
 
 	if v, ok := shared.m[key]; ok {
 		delete(shared.m, key)
+		delete(shared.versions, key)
 		dict.decreaseCount()
 		return v, true
 	} else {
@@ -216,19 +277,267 @@ func (dict *ShardDict) Remove(key string) (val interface{}, existed bool) {
 	}
 }
 
+// Upsert fn is called under the shard lock, so it must not use the dict
+func (dict *ShardDict) Upsert(key string, fn UpsertFunc) (val interface{}, err error) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	old, ok := shared.m[key]
+	if val, err = fn(old, ok); err != nil {
+		return nil, err
+	}
+	shared.m[key] = val
+	shared.versions[key] = dict.nextVersion(shared)
+	if !ok {
+		dict.addCount()
+	}
+	return val, nil
+}
+
+// RemoveIf the key will only be removed when cond holds for its value, cond is called under the shard lock
+func (dict *ShardDict) RemoveIf(key string, cond func(val interface{}) bool) (val interface{}, removed bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if v, ok := shared.m[key]; ok && cond(v) {
+		delete(shared.m, key)
+		delete(shared.versions, key)
+		dict.decreaseCount()
+		return v, true
+	}
+	return nil, false
+}
+
+// Compute fn is called under the shard lock, so it must not use the dict
+func (dict *ShardDict) Compute(key string, fn ComputeFunc) (val interface{}, exists bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	old, ok := shared.m[key]
+	val, keep := fn(old, ok)
+	if !keep {
+		if ok {
+			delete(shared.m, key)
+			delete(shared.versions, key)
+			dict.decreaseCount()
+		}
+		return nil, false
+	}
+	shared.m[key] = val
+	shared.versions[key] = dict.nextVersion(shared)
+	if !ok {
+		dict.addCount()
+	}
+	return val, true
+}
+
+func (dict *ShardDict) Merge(key string, val interface{}, fn MergeFunc) (merged interface{}, exists bool) {
+	return dict.Compute(key, func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return val, true
+		}
+		return fn(old, val)
+	})
+}
+
+// GetWithVersion returns the value along with its version, which changes every time the key is put
+func (dict *ShardDict) GetWithVersion(key string) (val interface{}, version uint64, exists bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.RLock()
+	defer shared.mutex.RUnlock()
+
+	val, exists = shared.m[key]
+	return val, shared.versions[key], exists
+}
+
+// CompareAndSwap the value will only be put when the key has the given version, the replaced one is returned
+func (dict *ShardDict) CompareAndSwap(key string, version uint64, val interface{}) (old interface{}, swapped bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	old, ok := shared.m[key]
+	if !ok || shared.versions[key] != version {
+		return nil, false
+	}
+	shared.m[key] = val
+	shared.versions[key] = dict.nextVersion(shared)
+	return old, true
+}
+
+// CompareAndDelete the key will only be removed when it has the given version
+func (dict *ShardDict) CompareAndDelete(key string, version uint64) (val interface{}, deleted bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	hashcode := dict.hashAlgo(dict.seed, key)
+	index := dict.spread(hashcode)
+	shared := dict.getShared(index)
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	val, ok := shared.m[key]
+	if !ok || shared.versions[key] != version {
+		return nil, false
+	}
+	delete(shared.m, key)
+	delete(shared.versions, key)
+	dict.decreaseCount()
+	return val, true
+}
+
+// groupByShard sorts the keys by shard and calls fn with the positions of the keys of every shard involved, so
+// that batches take every shard lock once
+func (dict *ShardDict) groupByShard(keys []string, fn func(shared *Shard, group []int)) {
+	indexes := make([]uint32, len(keys))
+	// starts[i+1] is first the number of keys of shard i, then the position of its keys in sorted
+	starts := make([]int, len(dict.table)+1)
+	for i, key := range keys {
+		indexes[i] = dict.spread(dict.hashAlgo(dict.seed, key))
+		starts[indexes[i]+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	sorted := make([]int, len(keys))
+	next := append([]int(nil), starts[:len(dict.table)]...)
+	for i, index := range indexes {
+		sorted[next[index]] = i
+		next[index]++
+	}
+	for i, shared := range dict.table {
+		if group := sorted[starts[i]:starts[i+1]]; len(group) > 0 {
+			fn(shared, group)
+		}
+	}
+}
+
+func (dict *ShardDict) GetMulti(keys []string) (vals []interface{}, exists []bool) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	vals, exists = make([]interface{}, len(keys)), make([]bool, len(keys))
+	dict.groupByShard(keys, func(shared *Shard, group []int) {
+		shared.mutex.RLock()
+		defer shared.mutex.RUnlock()
+		for _, i := range group {
+			vals[i], exists[i] = shared.m[keys[i]]
+		}
+	})
+	return vals, exists
+}
+
+func (dict *ShardDict) SwapMulti(vals map[string]interface{}) (olds map[string]interface{}) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	olds = make(map[string]interface{})
+	dict.groupByShard(keys, func(shared *Shard, group []int) {
+		shared.mutex.Lock()
+		defer shared.mutex.Unlock()
+		for _, i := range group {
+			key := keys[i]
+			if old, ok := shared.m[key]; ok {
+				olds[key] = old
+			} else {
+				dict.addCount()
+			}
+			shared.m[key] = vals[key]
+			shared.versions[key] = dict.nextVersion(shared)
+		}
+	})
+	return olds
+}
+
+func (dict *ShardDict) RemoveMulti(keys []string) (vals map[string]interface{}) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	vals = make(map[string]interface{})
+	dict.groupByShard(keys, func(shared *Shard, group []int) {
+		shared.mutex.Lock()
+		defer shared.mutex.Unlock()
+		for _, i := range group {
+			key := keys[i]
+			if v, ok := shared.m[key]; ok {
+				delete(shared.m, key)
+				delete(shared.versions, key)
+				dict.decreaseCount()
+				vals[key] = v
+			}
+		}
+	})
+	return vals
+}
+
+// RandomKeys picks each key from a random shard, the map iteration order of the shard giving a random key
+func (dict *ShardDict) RandomKeys(limit int) []string {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	keys := make([]string, 0, limit)
+	// bounded tries so that a sparse dict doesn't keep us looping
+	for i := 0; i < 2*limit && len(keys) < limit; i++ {
+		shared := dict.getShared(uint32(insecurerand.Intn(len(dict.table))))
+		shared.mutex.RLock()
+		for k := range shared.m {
+			keys = append(keys, k)
+			break
+		}
+		shared.mutex.RUnlock()
+	}
+	return keys
+}
+
 func (dict *ShardDict) ForEach(recall RecallFunc) {
 	if dict == nil {
 		return
 	}
 	for _, t := range dict.table {
-		t.mutex.RLock()
-		func() {
+		goon := func() bool {
+			t.mutex.RLock()
 			defer t.mutex.RUnlock()
 			for k, v := range t.m {
-				if recall(k, v) {
-					return
+				if !recall(k, v) {
+					return false
 				}
 			}
+			return true
 		}()
+		if !goon {
+			return
+		}
 	}
 }
@@ -7,12 +7,21 @@ import (
 
 type SimpleDict struct {
 	table map[string]interface{}
-	mu    sync.Mutex
-	count int32
+	// versions holds the version of every value of table, version is the last one given
+	versions map[string]uint64
+	version  uint64
+	mu       sync.Mutex
+	count    int32
 }
 
 func MakeSimpleDict() *SimpleDict {
-	return &SimpleDict{table: make(map[string]interface{})}
+	return &SimpleDict{table: make(map[string]interface{}), versions: make(map[string]uint64)}
+}
+
+// nextVersion is called under the lock
+func (sd *SimpleDict) nextVersion() uint64 {
+	sd.version++
+	return sd.version
 }
 
 func (sd *SimpleDict) addCount() {
@@ -28,9 +37,11 @@ func (sd *SimpleDict) Put(key string, val interface{}) (result int) {
 	defer sd.mu.Unlock()
 	if _, ok := sd.table[key]; ok {
 		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
 		return 0
 	} else {
 		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
 		sd.addCount()
 		return 1
 	}
@@ -44,7 +55,7 @@ func (sd *SimpleDict) Get(key string) (val interface{}, exists bool) {
 }
 
 func (sd *SimpleDict) Len() int {
-	return len(sd.table)
+	return int(atomic.LoadInt32(&sd.count))
 }
 
 func (sd *SimpleDict) PutIfAbsent(key string, val interface{}) (result int) {
@@ -54,6 +65,7 @@ func (sd *SimpleDict) PutIfAbsent(key string, val interface{}) (result int) {
 		return 0
 	} else {
 		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
 		sd.addCount()
 		return 1
 	}
@@ -64,18 +76,42 @@ func (sd *SimpleDict) PutIfExists(key string, val interface{}) (result int) {
 	defer sd.mu.Unlock()
 	if _, ok := sd.table[key]; ok {
 		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
 		return 1
 	} else {
 		return 0
 	}
 }
 
+func (sd *SimpleDict) Swap(key string, val interface{}) (old interface{}, existed bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	old, existed = sd.table[key]
+	sd.table[key] = val
+	sd.versions[key] = sd.nextVersion()
+	if !existed {
+		sd.addCount()
+	}
+	return
+}
+
+func (sd *SimpleDict) SwapIfExists(key string, val interface{}) (old interface{}, existed bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if old, existed = sd.table[key]; existed {
+		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
+	}
+	return
+}
+
 func (sd *SimpleDict) Remove(key string) (val interface{}, existed bool) {
 	sd.mu.Lock()
 	defer sd.mu.Unlock()
 
 	if v, ok := sd.table[key]; ok {
 		delete(sd.table, key)
+		delete(sd.versions, key)
 		sd.decreaseCount()
 		return v, true
 	} else {
@@ -83,7 +119,155 @@ func (sd *SimpleDict) Remove(key string) (val interface{}, existed bool) {
 	}
 }
 
+func (sd *SimpleDict) Upsert(key string, fn UpsertFunc) (val interface{}, err error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	old, ok := sd.table[key]
+	if val, err = fn(old, ok); err != nil {
+		return nil, err
+	}
+	sd.table[key] = val
+	sd.versions[key] = sd.nextVersion()
+	if !ok {
+		sd.addCount()
+	}
+	return val, nil
+}
+
+func (sd *SimpleDict) RemoveIf(key string, cond func(val interface{}) bool) (val interface{}, removed bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if v, ok := sd.table[key]; ok && cond(v) {
+		delete(sd.table, key)
+		delete(sd.versions, key)
+		sd.decreaseCount()
+		return v, true
+	}
+	return nil, false
+}
+
+func (sd *SimpleDict) Compute(key string, fn ComputeFunc) (val interface{}, exists bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	old, ok := sd.table[key]
+	val, keep := fn(old, ok)
+	if !keep {
+		if ok {
+			delete(sd.table, key)
+			delete(sd.versions, key)
+			sd.decreaseCount()
+		}
+		return nil, false
+	}
+	sd.table[key] = val
+	sd.versions[key] = sd.nextVersion()
+	if !ok {
+		sd.addCount()
+	}
+	return val, true
+}
+
+func (sd *SimpleDict) Merge(key string, val interface{}, fn MergeFunc) (merged interface{}, exists bool) {
+	return sd.Compute(key, func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return val, true
+		}
+		return fn(old, val)
+	})
+}
+
+func (sd *SimpleDict) GetWithVersion(key string) (val interface{}, version uint64, exists bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	val, exists = sd.table[key]
+	return val, sd.versions[key], exists
+}
+
+func (sd *SimpleDict) CompareAndSwap(key string, version uint64, val interface{}) (old interface{}, swapped bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	old, ok := sd.table[key]
+	if !ok || sd.versions[key] != version {
+		return nil, false
+	}
+	sd.table[key] = val
+	sd.versions[key] = sd.nextVersion()
+	return old, true
+}
+
+func (sd *SimpleDict) CompareAndDelete(key string, version uint64) (val interface{}, deleted bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	val, ok := sd.table[key]
+	if !ok || sd.versions[key] != version {
+		return nil, false
+	}
+	delete(sd.table, key)
+	delete(sd.versions, key)
+	sd.decreaseCount()
+	return val, true
+}
+
+func (sd *SimpleDict) GetMulti(keys []string) (vals []interface{}, exists []bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	vals, exists = make([]interface{}, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		vals[i], exists[i] = sd.table[key]
+	}
+	return vals, exists
+}
+
+func (sd *SimpleDict) SwapMulti(vals map[string]interface{}) (olds map[string]interface{}) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	olds = make(map[string]interface{})
+	for key, val := range vals {
+		if old, ok := sd.table[key]; ok {
+			olds[key] = old
+		} else {
+			sd.addCount()
+		}
+		sd.table[key] = val
+		sd.versions[key] = sd.nextVersion()
+	}
+	return olds
+}
+
+func (sd *SimpleDict) RemoveMulti(keys []string) (vals map[string]interface{}) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	vals = make(map[string]interface{})
+	for _, key := range keys {
+		if v, ok := sd.table[key]; ok {
+			delete(sd.table, key)
+			delete(sd.versions, key)
+			sd.decreaseCount()
+			vals[key] = v
+		}
+	}
+	return vals
+}
+
+func (sd *SimpleDict) RandomKeys(limit int) []string {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	keys := make([]string, 0, limit)
+	for k := range sd.table {
+		if len(keys) == limit {
+			break
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 func (sd *SimpleDict) ForEach(recall RecallFunc) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
 	for k, v := range sd.table {
 		if !recall(k, v) {
 			break
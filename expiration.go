@@ -0,0 +1,211 @@
+package m_cache
+
+import (
+	"m_cache/clock"
+	"m_cache/timewheel"
+	"time"
+)
+
+// ExpirationEngine selects how a Cache removes expired items in the
+// background. Expired items are never returned whichever the engine, it only
+// decides when their memory is reclaimed.
+type ExpirationEngine int
+
+const (
+	// TimeWheelExpiration schedules a job per item in a time wheel ticking
+	// every cleanup interval, items are removed as soon as they expire.
+	TimeWheelExpiration ExpirationEngine = iota
+	// SampledExpiration checks random keys every cleanup interval, like
+	// Redis does. It keeps no per item state, at the price of expired items
+	// lingering until they are sampled.
+	SampledExpiration
+)
+
+const (
+	defaultSampleSize      = 20
+	defaultMaxExpiredRatio = 0.25
+	// maxSampleRounds bounds the work done by a sampling cycle.
+	maxSampleRounds = 16
+)
+
+// expirer removes expired items in the background.
+type expirer interface {
+	// schedule makes sure the entry e of k is removed once expired.
+	schedule(k string, e *entry, d time.Duration)
+	// scheduleMulti schedules the entries which expire at once.
+	scheduleMulti(entries map[string]*entry)
+	// cancel forgets about k.
+	cancel(k string)
+	// cancelMulti forgets about the keys at once.
+	cancelMulti(keys []string)
+	// clear forgets about all the keys.
+	clear()
+	// pending returns the number of scheduled removals.
+	pending() int
+	// stop stops the background work and waits for it to return.
+	stop()
+}
+
+func newExpirer(c *cache, ci time.Duration) expirer {
+	if ci <= 0 {
+		return nil
+	}
+	switch c.expirationEngine {
+	case SampledExpiration:
+		return newSampledExpirer(c, ci)
+	default:
+		return newWheelExpirer(c, ci)
+	}
+}
+
+type wheelExpirer struct {
+	c  *cache
+	tw *timewheel.TimeWheel
+}
+
+func newWheelExpirer(c *cache, ci time.Duration) *wheelExpirer {
+	tw := timewheel.NewWithClock(ci, wheelSlots, c.clock)
+	tw.Start()
+	return &wheelExpirer{c: c, tw: tw}
+}
+
+func (w *wheelExpirer) schedule(k string, e *entry, d time.Duration) {
+	w.tw.AddJob(k, d, func() {
+		w.expire(k)
+	})
+}
+
+func (w *wheelExpirer) scheduleMulti(entries map[string]*entry) {
+	now := w.c.now()
+	jobs := make([]timewheel.Job, 0, len(entries))
+	for k, e := range entries {
+		if expiration := e.expiresAt(); expiration > 0 {
+			k := k
+			jobs = append(jobs, timewheel.Job{Key: k, Delay: time.Duration(expiration - now), Job: func() {
+				w.expire(k)
+			}})
+		}
+	}
+	w.tw.AddJobs(jobs)
+}
+
+// expire is the job run by the time wheel for k. There is a single job per
+// key, and the wheel may run it a bit early, or after the entry it was added
+// for was replaced or got its TTL changed. So it only removes an expired
+// entry, and reschedules itself for the one found otherwise.
+func (w *wheelExpirer) expire(k string) {
+	if w.c.removeExpired(k) {
+		return
+	}
+	if v, found := w.c.items.Get(k); found {
+		e := v.(*entry)
+		if expiration := e.expiresAt(); expiration > 0 {
+			w.schedule(k, e, time.Duration(expiration-w.c.now()))
+		}
+	}
+}
+
+func (w *wheelExpirer) cancel(k string) {
+	w.tw.RemoveJob(k)
+}
+
+func (w *wheelExpirer) cancelMulti(keys []string) {
+	w.tw.RemoveJobs(keys)
+}
+
+func (w *wheelExpirer) clear() {
+	w.tw.Clear()
+}
+
+func (w *wheelExpirer) pending() int {
+	return w.tw.Len()
+}
+
+func (w *wheelExpirer) stop() {
+	w.tw.Stop()
+}
+
+type sampledExpirer struct {
+	c               *cache
+	ticker          clock.Ticker
+	stopChannel     chan struct{}
+	done            chan struct{}
+	sampleSize      int
+	maxExpiredRatio float64
+}
+
+func newSampledExpirer(c *cache, ci time.Duration) *sampledExpirer {
+	s := &sampledExpirer{
+		c:               c,
+		ticker:          c.clock.NewTicker(ci),
+		stopChannel:     make(chan struct{}),
+		done:            make(chan struct{}),
+		sampleSize:      c.sampleSize,
+		maxExpiredRatio: c.maxExpiredRatio,
+	}
+	if s.sampleSize <= 0 {
+		s.sampleSize = defaultSampleSize
+	}
+	if s.maxExpiredRatio <= 0 {
+		s.maxExpiredRatio = defaultMaxExpiredRatio
+	}
+	go s.run()
+	return s
+}
+
+func (s *sampledExpirer) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.ticker.C():
+			s.cycle()
+		case <-s.stopChannel:
+			s.ticker.Stop()
+			return
+		}
+	}
+}
+
+// cycle removes the expired keys among a random sample, and starts over
+// while more than maxExpiredRatio of the sample had expired.
+func (s *sampledExpirer) cycle() {
+	for round := 0; round < maxSampleRounds; round++ {
+		keys := s.c.items.RandomKeys(s.sampleSize)
+		if len(keys) == 0 {
+			return
+		}
+		expired := 0
+		for _, k := range keys {
+			if s.c.removeExpired(k) {
+				expired++
+			}
+		}
+		if float64(expired)/float64(len(keys)) <= s.maxExpiredRatio {
+			return
+		}
+	}
+}
+
+func (s *sampledExpirer) schedule(k string, e *entry, d time.Duration) {
+}
+
+func (s *sampledExpirer) scheduleMulti(entries map[string]*entry) {
+}
+
+func (s *sampledExpirer) cancel(k string) {
+}
+
+func (s *sampledExpirer) cancelMulti(keys []string) {
+}
+
+func (s *sampledExpirer) clear() {
+}
+
+func (s *sampledExpirer) pending() int {
+	return 0
+}
+
+func (s *sampledExpirer) stop() {
+	close(s.stopChannel)
+	<-s.done
+}
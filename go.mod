@@ -1,3 +1,3 @@
 module m_cache
 
-go 1.16
+go 1.18
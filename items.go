@@ -0,0 +1,101 @@
+package m_cache
+
+import (
+	"m_cache/policies"
+	"time"
+)
+
+// Item is an item of the m-cache, as returned by Items.
+type Item struct {
+	Object interface{}
+	// Expiration is the UnixNano time the item expires at, 0 if it doesn't.
+	Expiration int64
+}
+
+// Expired tells whether the item has expired at the given time.
+func (item Item) Expired(now time.Time) bool {
+	return item.Expiration > 0 && now.UnixNano() >= item.Expiration
+}
+
+// Range calls fn for every item which hasn't expired, until it returns false.
+// The items are visited while the shard of the dict they are in is locked,
+// so fn must not modify the m-cache.
+func (c *cache) Range(fn func(k string, x interface{}) bool) {
+	if c.Closed() {
+		return
+	}
+	now := c.now()
+	c.items.ForEach(func(k string, v interface{}) bool {
+		if e := v.(*entry); !e.expired(now) {
+			return fn(k, e.value)
+		}
+		return true
+	})
+}
+
+// Keys returns the keys of the items which haven't expired.
+func (c *cache) Keys() []string {
+	keys := make([]string, 0, c.items.Len())
+	c.Range(func(k string, x interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// Items returns a copy of the items which haven't expired.
+func (c *cache) Items() map[string]Item {
+	items := make(map[string]Item, c.items.Len())
+	if c.Closed() {
+		return items
+	}
+	now := c.now()
+	c.items.ForEach(func(k string, v interface{}) bool {
+		if e := v.(*entry); !e.expired(now) {
+			items[k] = Item{Object: e.value, Expiration: e.expiresAt()}
+		}
+		return true
+	})
+	return items
+}
+
+// Count returns the number of items which haven't expired, unlike Len which
+// counts the expired items not removed yet.
+func (c *cache) Count() int {
+	n := 0
+	c.Range(func(k string, x interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Flush removes all the items, which are notified with the Flushed reason.
+// It is atomic with respect to the writers: an item being set is either
+// stored before the flush and removed by it, or stored after it.
+func (c *cache) Flush() {
+	if c.Closed() {
+		return
+	}
+	c.flushMu.Lock()
+	var keys []string
+	c.items.ForEach(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	vals := c.items.RemoveMulti(keys)
+	if r, ok := c.policy.(policies.Resetter); ok {
+		r.Reset()
+	} else {
+		policies.EvictMulti(c.policy, keys)
+	}
+	if c.expirer != nil {
+		c.expirer.clear()
+	}
+	c.flushMu.Unlock()
+	for _, k := range keys {
+		if v, existed := vals[k]; existed {
+			c.removed(k, v.(*entry), Flushed, nil)
+		}
+	}
+}
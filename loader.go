@@ -0,0 +1,156 @@
+package m_cache
+
+import (
+	"context"
+	"fmt"
+	"m_cache/clock"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader fetches the value of a missing key. It returns the value together
+// with the expiration that should be used to store it.
+type Loader func(ctx context.Context) (interface{}, time.Duration, error)
+
+// KeyLoader fetches the value of any key, it's registered with WithRefresh
+// to reload stale items.
+type KeyLoader func(ctx context.Context, k string) (interface{}, time.Duration, error)
+
+// call is an in-flight or completed Loader invocation.
+type call struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type failedLoad struct {
+	err      error
+	expireAt time.Time
+}
+
+// loadGroup makes sure that only one load per key is in flight at a time,
+// and shares its result with all the callers waiting for it.
+type loadGroup struct {
+	mu            sync.Mutex
+	calls         map[string]*call
+	failed        map[string]failedLoad
+	errExpiration time.Duration
+	clock         clock.Clock
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{
+		calls:  make(map[string]*call),
+		failed: make(map[string]failedLoad),
+	}
+}
+
+// do runs fn for key unless a run is already in flight, in which case it
+// waits for that one. The run itself is detached from ctx: it is canceled only
+// when every caller waiting for it has given up.
+func (g *loadGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if f, ok := g.failed[key]; ok {
+		if g.clock.Now().Before(f.expireAt) {
+			g.mu.Unlock()
+			return nil, f.err
+		}
+		delete(g.failed, key)
+	}
+	cl, ok := g.calls[key]
+	if !ok {
+		lctx, cancel := context.WithCancel(context.Background())
+		cl = &call{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = cl
+		go g.run(lctx, key, cl, fn)
+	}
+	cl.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.val, cl.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		cl.waiters--
+		if cl.waiters == 0 {
+			// nobody is interested anymore, let the next caller start over
+			if g.calls[key] == cl {
+				delete(g.calls, key)
+			}
+			cl.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (g *loadGroup) run(ctx context.Context, key string, cl *call, fn func(ctx context.Context) (interface{}, error)) {
+	defer cl.cancel()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				cl.val, cl.err = nil, fmt.Errorf("loader of %s panicked: %v", key, r)
+			}
+		}()
+		cl.val, cl.err = fn(ctx)
+	}()
+
+	g.mu.Lock()
+	if g.calls[key] == cl {
+		delete(g.calls, key)
+	}
+	if cl.err != nil && ctx.Err() == nil && g.errExpiration > 0 {
+		g.failed[key] = failedLoad{err: cl.err, expireAt: g.clock.Now().Add(g.errExpiration)}
+	}
+	g.mu.Unlock()
+	close(cl.done)
+}
+
+// GetOrLoad returns the value of k, calling loader to fetch and store it when
+// it's missing. Concurrent callers for the same key share a single loader
+// call. Loader errors are returned to every waiter but are not cached unless
+// WithLoaderErrorExpiration is given.
+func (c *cache) GetOrLoad(ctx context.Context, k string, loader Loader) (interface{}, error) {
+	if c.Closed() {
+		return nil, ErrClosed
+	}
+	if v, found := c.Get(k); found {
+		return v, nil
+	}
+	return c.loads.do(ctx, k, func(ctx context.Context) (interface{}, error) {
+		atomic.AddUint64(&c.stats.loaderCalls, 1)
+		v, d, err := loader(ctx)
+		if err != nil {
+			atomic.AddUint64(&c.stats.loaderErrors, 1)
+			return nil, err
+		}
+		c.Set(k, v, d)
+		return v, nil
+	})
+}
+
+// refresh reloads the stale entry e of k in the background, once at a time.
+// The stale value keeps being served until the reload succeeds, a failed
+// reload is tried again on the next read.
+func (c *cache) refresh(k string, e *entry) {
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&e.refreshing, 0)
+		c.loads.do(context.Background(), k, func(ctx context.Context) (interface{}, error) {
+			atomic.AddUint64(&c.stats.loaderCalls, 1)
+			v, d, err := c.refreshLoader(ctx, k)
+			if err != nil {
+				atomic.AddUint64(&c.stats.loaderErrors, 1)
+				return nil, err
+			}
+			c.Set(k, v, d)
+			return v, nil
+		})
+	}()
+}
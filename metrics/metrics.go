@@ -0,0 +1,136 @@
+// Package metrics exports the counters of m-caches in the Prometheus text
+// exposition format, without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"m_cache"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds the named caches to export, every sample carries the name
+// of its cache in the "cache" label.
+type Registry struct {
+	mu     sync.RWMutex
+	caches map[string]*m_cache.Cache
+}
+
+func NewRegistry() *Registry {
+	return &Registry{caches: make(map[string]*m_cache.Cache)}
+}
+
+// DefaultRegistry is the registry used by Register, Unregister and Handler.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a cache to export under name.
+func (r *Registry) Register(name string, c *m_cache.Cache) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.caches[name]; ok {
+		return fmt.Errorf("cache %s is already registered", name)
+	}
+	r.caches[name] = c
+	return nil
+}
+
+// Unregister stops exporting the cache registered under name.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.caches, name)
+}
+
+func Register(name string, c *m_cache.Cache) error {
+	return DefaultRegistry.Register(name, c)
+}
+
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
+// Handler returns the http.Handler exporting the caches of DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(c *m_cache.Cache, s m_cache.Stats) float64
+}
+
+var metrics = []metric{
+	{"m_cache_hits_total", "Number of lookups which found their key.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Hits) }},
+	{"m_cache_misses_total", "Number of lookups which didn't find their key.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Misses) }},
+	{"m_cache_sets_total", "Number of items set.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Sets) }},
+	{"m_cache_adds_failed_total", "Number of Add calls which failed.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.AddsFailed) }},
+	{"m_cache_replaces_failed_total", "Number of Replace calls which failed.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.ReplacesFailed) }},
+	{"m_cache_deletes_total", "Number of items deleted.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Deletes) }},
+	{"m_cache_expirations_total", "Number of items removed on expiration.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Expirations) }},
+	{"m_cache_evictions_total", "Number of items evicted to make room for others.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.Evictions) }},
+	{"m_cache_loader_calls_total", "Number of loader calls.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.LoaderCalls) }},
+	{"m_cache_loader_errors_total", "Number of loader calls which returned an error.", "counter",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(s.LoaderErrors) }},
+	{"m_cache_items", "Number of items in the cache.", "gauge",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(c.Len()) }},
+	{"m_cache_capacity", "Maximum number of items allowed by the eviction policy.", "gauge",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(c.Capacity()) }},
+	{"m_cache_cost", "Total cost of the items in the cache.", "gauge",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(c.Cost()) }},
+	{"m_cache_max_cost", "Maximum total cost of the items, 0 means no limit.", "gauge",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(c.MaxCost()) }},
+	{"m_cache_pending_expirations", "Number of expiration jobs waiting in the time wheel.", "gauge",
+		func(c *m_cache.Cache, s m_cache.Stats) float64 { return float64(c.PendingExpirations()) }},
+}
+
+// ServeHTTP renders the metrics of every registered cache.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.caches))
+	caches := make([]*m_cache.Cache, 0, len(r.caches))
+	for name := range r.caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		caches = append(caches, r.caches[name])
+	}
+	r.mu.RUnlock()
+
+	stats := make([]m_cache.Stats, len(caches))
+	for i, c := range caches {
+		stats[i] = c.Stats()
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for i, c := range caches {
+			fmt.Fprintf(bw, "%s{cache=\"%s\"} %g\n", m.name, escapeLabel(names[i]), m.value(c, stats[i]))
+		}
+	}
+	bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
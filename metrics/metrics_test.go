@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"m_cache"
+	"m_cache/dict"
+	"m_cache/policies"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	a := m_cache.New(m_cache.DefaultExpiration, time.Second, dict.MakeShardDict(16), policies.NewLRU(10))
+	b := m_cache.New(m_cache.DefaultExpiration, 0, dict.MakeShardDict(16), policies.NewLRU(20))
+	if err := r.Register("a", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(`b"`, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("a", b); err == nil {
+		t.Error("registering a name twice should fail")
+	}
+
+	a.Set("x", 1, time.Minute)
+	a.Get("x")
+	a.Get("y")
+	// the time wheel takes its messages one at a time, it has scheduled the
+	// expiration of x once it takes the cancellation of the missing y
+	a.Delete("y")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	out := string(body)
+
+	for _, line := range []string{
+		"# TYPE m_cache_hits_total counter",
+		`m_cache_hits_total{cache="a"} 1`,
+		`m_cache_misses_total{cache="a"} 1`,
+		`m_cache_items{cache="a"} 1`,
+		`m_cache_capacity{cache="a"} 10`,
+		`m_cache_pending_expirations{cache="a"} 1`,
+		`m_cache_capacity{cache="b\""} 20`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Error("unexpected content type", ct)
+	}
+}
@@ -0,0 +1,174 @@
+package m_cache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is wrapped by the errors of the operations which need an
+// existing item.
+var ErrNotFound = errors.New("item not found")
+
+// NotNumericError is returned by the numeric operations when the item doesn't
+// hold a value of the kind they work on.
+type NotNumericError struct {
+	Key   string
+	Value interface{}
+	// Expected is the kind of number expected, "integer" or "float"
+	Expected string
+}
+
+func (e *NotNumericError) Error() string {
+	article := "a"
+	if e.Expected == "integer" {
+		article = "an"
+	}
+	return fmt.Sprintf("item %s holds a %T, not %s %s", e.Key, e.Value, article, e.Expected)
+}
+
+// Increment adds delta to the integer held by k, whatever its integer type,
+// and returns the result converted to int64. The result wraps around like
+// the Go arithmetic of the stored type does. With a refresh loader, k no
+// longer gets stale once updated and expires at the end of its grace period.
+func (c *cache) Increment(k string, delta int64) (int64, error) {
+	return c.incrementInt(k, delta, false, 0)
+}
+
+// Decrement subtracts delta from the integer held by k, see Increment.
+func (c *cache) Decrement(k string, delta int64) (int64, error) {
+	return c.incrementInt(k, -delta, false, 0)
+}
+
+// IncrementOrCreate is Increment, except that a missing k is set to
+// int64(delta) with the expiration d.
+func (c *cache) IncrementOrCreate(k string, delta int64, d time.Duration) (int64, error) {
+	return c.incrementInt(k, delta, true, d)
+}
+
+// IncrementFloat adds delta to the float32 or float64 held by k.
+func (c *cache) IncrementFloat(k string, delta float64) (float64, error) {
+	return c.incrementFloat(k, delta, false, 0)
+}
+
+// DecrementFloat subtracts delta from the float32 or float64 held by k.
+func (c *cache) DecrementFloat(k string, delta float64) (float64, error) {
+	return c.incrementFloat(k, -delta, false, 0)
+}
+
+// IncrementFloatOrCreate is IncrementFloat, except that a missing k is set
+// to delta with the expiration d.
+func (c *cache) IncrementFloatOrCreate(k string, delta float64, d time.Duration) (float64, error) {
+	return c.incrementFloat(k, delta, true, d)
+}
+
+func (c *cache) incrementInt(k string, delta int64, create bool, d time.Duration) (int64, error) {
+	result := delta
+	err := c.updateNumber(k, delta, "integer", create, d, func(x interface{}) (interface{}, bool) {
+		var v interface{}
+		switch n := x.(type) {
+		case int:
+			v, result = n+int(delta), int64(n+int(delta))
+		case int8:
+			v, result = n+int8(delta), int64(n+int8(delta))
+		case int16:
+			v, result = n+int16(delta), int64(n+int16(delta))
+		case int32:
+			v, result = n+int32(delta), int64(n+int32(delta))
+		case int64:
+			v, result = n+delta, n+delta
+		case uint:
+			v, result = n+uint(delta), int64(n+uint(delta))
+		case uintptr:
+			v, result = n+uintptr(delta), int64(n+uintptr(delta))
+		case uint8:
+			v, result = n+uint8(delta), int64(n+uint8(delta))
+		case uint16:
+			v, result = n+uint16(delta), int64(n+uint16(delta))
+		case uint32:
+			v, result = n+uint32(delta), int64(n+uint32(delta))
+		case uint64:
+			v, result = n+uint64(delta), int64(n+uint64(delta))
+		default:
+			return nil, false
+		}
+		return v, true
+	})
+	return result, err
+}
+
+func (c *cache) incrementFloat(k string, delta float64, create bool, d time.Duration) (float64, error) {
+	result := delta
+	err := c.updateNumber(k, delta, "float", create, d, func(x interface{}) (interface{}, bool) {
+		switch n := x.(type) {
+		case float32:
+			n += float32(delta)
+			result = float64(n)
+			return n, true
+		case float64:
+			n += delta
+			result = n
+			return n, true
+		}
+		return nil, false
+	})
+	return result, err
+}
+
+// updateNumber replaces the value of k by the one returned by add, under the
+// lock of k. A missing k is set to initial if create is true. kind names the
+// numbers add works on.
+func (c *cache) updateNumber(k string, initial interface{}, kind string, create bool, d time.Duration, add func(x interface{}) (interface{}, bool)) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	cost := c.costOf(k, initial)
+	if create && !c.makeRoom(k, cost) {
+		return fmt.Errorf("item %s isn't admitted by the eviction policy", k)
+	}
+	now := c.now()
+	var expired, created *entry
+	c.flushMu.RLock()
+	_, err := c.items.Upsert(k, func(old interface{}, exists bool) (interface{}, error) {
+		expired, created = nil, nil
+		if exists && old.(*entry).expired(now) {
+			expired, exists = old.(*entry), false
+		}
+		if !exists {
+			if !create {
+				return nil, fmt.Errorf("item %s: %w", k, ErrNotFound)
+			}
+			created = c.newEntry(initial, cost, d, c.slidingOf(d))
+			// like the updated counters, it isn't reloaded by the refresh loader
+			created.refreshAt = 0
+			return created, nil
+		}
+		e := old.(*entry)
+		v, ok := add(e.value)
+		if !ok {
+			return nil, &NotNumericError{Key: k, Value: e.value, Expected: kind}
+		}
+		return e.withValue(v), nil
+	})
+	if err != nil {
+		c.flushMu.RUnlock()
+		return err
+	}
+	if created != nil {
+		atomic.AddInt64(&c.cost, cost)
+		c.policy.Promote(k)
+		c.scheduleExpiration(k, created)
+		atomic.AddUint64(&c.stats.sets, 1)
+	} else {
+		c.policy.PromoteIfExist(k)
+	}
+	c.flushMu.RUnlock()
+	if expired != nil {
+		c.removed(k, expired, Expired, nil)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package m_cache
+
+import (
+	"m_cache/clock"
+	"time"
+)
+
+// Option configures optional behaviours of a Cache created by New.
+type Option func(c *cache)
+
+// WithLoaderErrorExpiration makes GetOrLoad remember a failed load for d, so
+// that callers asking for the same key during that window get the error back
+// without calling the loader again. Errors are not cached by default.
+func WithLoaderErrorExpiration(d time.Duration) Option {
+	return func(c *cache) {
+		c.loads.errExpiration = d
+	}
+}
+
+// WithSizer sets the function computing the cost of the items stored by
+// Set, Add and Replace. Without it every item costs 1.
+func WithSizer(sizer func(key string, val interface{}) int64) Option {
+	return func(c *cache) {
+		c.sizer = sizer
+	}
+}
+
+// WithMaxCost bounds the total cost of the items in the m-cache, items are
+// evicted until a new one fits under the budget.
+func WithMaxCost(maxCost int64) Option {
+	return func(c *cache) {
+		c.maxCost = maxCost
+	}
+}
+
+// WithCodec sets the Codec of the snapshots written by Save and read by
+// Load, GobCodec is used by default.
+func WithCodec(codec Codec) Option {
+	return func(c *cache) {
+		c.codec = codec
+	}
+}
+
+// WithClock sets the clock used by the m-cache and its time wheel, the
+// system clock is used by default.
+func WithClock(clk clock.Clock) Option {
+	return func(c *cache) {
+		c.clock = clk
+	}
+}
+
+// WithExpirationEngine selects how expired items are removed in the
+// background, TimeWheelExpiration is used by default.
+func WithExpirationEngine(engine ExpirationEngine) Option {
+	return func(c *cache) {
+		c.expirationEngine = engine
+	}
+}
+
+// WithSampledExpiration selects SampledExpiration: every cleanup interval
+// sampleSize random keys are checked, and sampling goes on while more than
+// maxExpiredRatio of them had expired. Zero values select the defaults of 20
+// keys and 0.25.
+func WithSampledExpiration(sampleSize int, maxExpiredRatio float64) Option {
+	return func(c *cache) {
+		c.expirationEngine = SampledExpiration
+		c.sampleSize = sampleSize
+		c.maxExpiredRatio = maxExpiredRatio
+	}
+}
+
+// WithNotifyOnClose makes Close remove the remaining items with the Flushed
+// reason, so that the OnRemoval function sees every item leave.
+func WithNotifyOnClose() Option {
+	return func(c *cache) {
+		c.notifyOnClose = true
+	}
+}
+
+// WithSlidingExpiration makes the expiration of the items slide: an item
+// expires once it hasn't been read for the duration given when it was set.
+func WithSlidingExpiration() Option {
+	return func(c *cache) {
+		c.slidingExpiration = true
+	}
+}
+
+// WithRefresh enables stale-while-revalidate: an item set for d becomes
+// stale after d, reads then still return it but reload it in the background
+// with loader, and it's only removed once grace has passed since it became
+// stale without being reloaded.
+func WithRefresh(loader KeyLoader, grace time.Duration) Option {
+	return func(c *cache) {
+		c.refreshLoader = loader
+		c.refreshGrace = grace
+	}
+}
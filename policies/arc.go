@@ -0,0 +1,250 @@
+package policies
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	inT1 = iota
+	inT2
+	inB1
+	inB2
+)
+
+// ARC is the Adaptive Replacement Cache policy. Keys seen once live in T1
+// and keys seen again in T2, B1 and B2 remember the keys recently evicted
+// from them. A hit on a ghost shifts the target size of T1 towards the list
+// which would have kept it, so the policy adapts between recency-heavy and
+// frequency-heavy workloads. Keys used only once never reach T2, which makes
+// ARC resistant to scans.
+type ARC struct {
+	maxCap int64
+	// p is the target size of T1
+	p      int
+	lists  [4]*list.List
+	index  map[string]*list.Element
+	banned map[string]struct{}
+	mu     sync.Mutex
+}
+
+type arcEntry struct {
+	key  string
+	list int
+}
+
+func NewARC(maxCap int64) *ARC {
+	a := &ARC{
+		maxCap: maxCap,
+		index:  make(map[string]*list.Element),
+		banned: make(map[string]struct{}),
+	}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+func (a *ARC) SetCapacity(capacity int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxCap = capacity
+	if int64(a.p) > capacity {
+		a.p = int(capacity)
+	}
+	a.trimGhosts()
+}
+
+func (a *ARC) Capacity() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.maxCap
+}
+
+func (a *ARC) Promote(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.promote(key)
+}
+
+func (a *ARC) PromoteMulti(keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		a.promote(key)
+	}
+}
+
+func (a *ARC) promote(key string) {
+	if _, ok := a.banned[key]; ok {
+		return
+	}
+	e, ok := a.index[key]
+	if !ok {
+		a.push(key, inT1)
+		a.trimGhosts()
+		return
+	}
+	b1, b2 := a.lists[inB1].Len(), a.lists[inB2].Len()
+	switch e.Value.(*arcEntry).list {
+	case inB1:
+		a.p = min(a.p+max(1, b2/b1), int(a.maxCap))
+	case inB2:
+		a.p = max(a.p-max(1, b1/b2), 0)
+	}
+	a.move(e, inT2)
+}
+
+func (a *ARC) PromoteIfExist(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.promoteIfExist(key)
+}
+
+func (a *ARC) PromoteIfExistMulti(keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		a.promoteIfExist(key)
+	}
+}
+
+func (a *ARC) promoteIfExist(key string) {
+	if e, ok := a.index[key]; ok {
+		if l := e.Value.(*arcEntry).list; l == inT1 || l == inT2 {
+			a.move(e, inT2)
+		}
+	}
+}
+
+// Evict removes the 'm-cache key' without remembering it in a ghost list.
+func (a *ARC) Evict(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.evict(key)
+}
+
+func (a *ARC) EvictMulti(keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		a.evict(key)
+	}
+}
+
+func (a *ARC) evict(key string) {
+	if e, ok := a.index[key]; ok {
+		if l := e.Value.(*arcEntry).list; l == inT1 || l == inT2 {
+			a.remove(e)
+		}
+	}
+}
+
+func (a *ARC) Ban(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.index[key]; ok {
+		a.remove(e)
+	}
+	a.banned[key] = struct{}{}
+}
+
+// NowEvict evicts the least recent key of T1 while T1 is above its target
+// size, the one of T2 otherwise, and keeps it as a ghost.
+func (a *ARC) NowEvict() (key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nowEvict()
+}
+
+func (a *ARC) AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return admitEach(keys, full, evicted, func(key string) string {
+		return a.nowEvict()
+	})
+}
+
+func (a *ARC) nowEvict() (key string) {
+	t1, t2 := a.lists[inT1], a.lists[inT2]
+	var e *list.Element
+	if t1.Len() > 0 && (t1.Len() > a.p || t2.Len() == 0) {
+		e = t1.Back()
+		a.move(e, inB1)
+	} else if t2.Len() > 0 {
+		e = t2.Back()
+		a.move(e, inB2)
+	} else {
+		return ""
+	}
+	a.trimGhosts()
+	return e.Value.(*arcEntry).key
+}
+
+// Reset forgets the ghosts along with the resident keys, and the target size
+// of T1.
+func (a *ARC) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, l := range a.lists {
+		l.Init()
+	}
+	a.index = make(map[string]*list.Element)
+	a.p = 0
+}
+
+// Keys lists the resident keys of T1 then those of T2, ghosts are left out.
+func (a *ARC) Keys() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := make([]string, 0, a.lists[inT1].Len()+a.lists[inT2].Len())
+	for _, l := range []*list.List{a.lists[inT1], a.lists[inT2]} {
+		for e := l.Back(); e != nil; e = e.Prev() {
+			keys = append(keys, e.Value.(*arcEntry).key)
+		}
+	}
+	return keys
+}
+
+// trimGhosts keeps |T1|+|B1| and the size of all lists within the
+// directory sizes of c and 2c.
+func (a *ARC) trimGhosts() {
+	c := int(a.maxCap)
+	for a.lists[inB1].Len() > 0 && a.lists[inT1].Len()+a.lists[inB1].Len() > c {
+		a.remove(a.lists[inB1].Back())
+	}
+	for a.lists[inB2].Len() > 0 && len(a.index) > 2*c {
+		a.remove(a.lists[inB2].Back())
+	}
+}
+
+func (a *ARC) push(key string, to int) {
+	a.index[key] = a.lists[to].PushFront(&arcEntry{key: key, list: to})
+}
+
+func (a *ARC) move(e *list.Element, to int) {
+	entry := e.Value.(*arcEntry)
+	a.lists[entry.list].Remove(e)
+	entry.list = to
+	a.index[entry.key] = a.lists[to].PushFront(entry)
+}
+
+func (a *ARC) remove(e *list.Element) {
+	entry := e.Value.(*arcEntry)
+	a.lists[entry.list].Remove(e)
+	delete(a.index, entry.key)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package policies
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestARCScanResistance(t *testing.T) {
+	a := NewARC(100)
+	var resident int
+	add := func(k string) {
+		if resident >= 100 {
+			a.NowEvict()
+			resident--
+		}
+		a.Promote(k)
+		resident++
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			k := "hot" + strconv.Itoa(i)
+			if _, ok := a.index[k]; ok && round > 0 {
+				a.PromoteIfExist(k)
+			} else {
+				add(k)
+			}
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		add("scan" + strconv.Itoa(i))
+	}
+	for i := 0; i < 50; i++ {
+		e, ok := a.index["hot"+strconv.Itoa(i)]
+		if !ok || e.Value.(*arcEntry).list != inT2 {
+			t.Error("hot key was evicted by the scan:", i)
+		}
+	}
+}
+
+func TestARCAdapts(t *testing.T) {
+	a := NewARC(4)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		a.Promote(k)
+	}
+	if k := a.NowEvict(); k != "a" {
+		t.Error("expected a to be evicted, got", k)
+	}
+	// a comes back from B1, T1 should be given more room
+	a.Promote("a")
+	if a.p != 1 {
+		t.Error("expected target size of T1 to grow to 1, got", a.p)
+	}
+	if e := a.index["a"]; e.Value.(*arcEntry).list != inT2 {
+		t.Error("a ghost hit should move a to T2")
+	}
+}
@@ -0,0 +1,49 @@
+package policies
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// BenchmarkLRU runs a Get/Set mix against caches of growing size, the time
+// per op should stay flat.
+func BenchmarkLRU(b *testing.B) {
+	for _, size := range []int{1000, 100000, 1000000, 5000000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkPolicy(b, NewLRU(int64(size)), size)
+		})
+	}
+}
+
+func benchmarkPolicy(b *testing.B, p EvictionPolicy, size int) {
+	keys := make([]string, size)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		p.Promote(keys[i])
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[r.Intn(size)]
+		switch i % 4 {
+		case 0:
+			p.NowEvict()
+			p.Promote(key)
+		case 1:
+			p.Promote(key)
+		default:
+			p.PromoteIfExist(key)
+		}
+	}
+}
+
+func BenchmarkLFU(b *testing.B) {
+	for _, size := range []int{1000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkPolicy(b, NewLFU(int64(size)), size)
+		})
+	}
+}
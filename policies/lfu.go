@@ -0,0 +1,255 @@
+package policies
+
+import (
+	"container/list"
+	"m_cache/clock"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LFU evicts the least frequently used key, the least recently used one
+// among keys of the same frequency. Keys are grouped into frequency buckets
+// kept in ascending order, so that all operations are O(1).
+type LFU struct {
+	maxCap  int64
+	buckets *list.List
+	index   map[string]*lfuEntry
+	banned  map[string]struct{}
+	mu      sync.Mutex
+
+	agingInterval time.Duration
+	lastAged      time.Time
+	clock         clock.Clock
+}
+
+type lfuBucket struct {
+	freq int64
+	// entries of the bucket, the most recently used at the front
+	entries *list.List
+}
+
+type lfuEntry struct {
+	key    string
+	bucket *list.Element
+	elem   *list.Element
+}
+
+func NewLFU(maxCap int64) *LFU {
+	return &LFU{
+		maxCap:  maxCap,
+		buckets: list.New(),
+		index:   make(map[string]*lfuEntry),
+		banned:  make(map[string]struct{}),
+	}
+}
+
+// NewLFUWithAging returns an LFU which halves all the frequencies every
+// agingInterval, so that formerly hot keys eventually become evictable.
+func NewLFUWithAging(maxCap int64, agingInterval time.Duration) *LFU {
+	return NewLFUWithAgingClock(maxCap, agingInterval, clock.Real)
+}
+
+// NewLFUWithAgingClock is NewLFUWithAging, with the aging interval measured
+// on the given clock.
+func NewLFUWithAgingClock(maxCap int64, agingInterval time.Duration, clk clock.Clock) *LFU {
+	l := NewLFU(maxCap)
+	l.agingInterval = agingInterval
+	l.clock = clk
+	l.lastAged = clk.Now()
+	return l
+}
+
+func (L *LFU) SetCapacity(capacity int64) {
+	atomic.StoreInt64(&L.maxCap, capacity)
+}
+
+func (L *LFU) Capacity() int64 {
+	return atomic.LoadInt64(&L.maxCap)
+}
+
+func (L *LFU) Promote(key string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.age()
+	L.promote(key)
+}
+
+func (L *LFU) PromoteMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.age()
+	for _, key := range keys {
+		L.promote(key)
+	}
+}
+
+func (L *LFU) promote(key string) {
+	if _, ok := L.banned[key]; ok {
+		return
+	}
+	if e, ok := L.index[key]; ok {
+		L.increment(e)
+		return
+	}
+	front := L.buckets.Front()
+	if front == nil || front.Value.(*lfuBucket).freq != 1 {
+		front = L.buckets.PushFront(&lfuBucket{freq: 1, entries: list.New()})
+	}
+	e := &lfuEntry{key: key, bucket: front}
+	e.elem = front.Value.(*lfuBucket).entries.PushFront(e)
+	L.index[key] = e
+}
+
+func (L *LFU) PromoteIfExist(key string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.age()
+	if e, ok := L.index[key]; ok {
+		L.increment(e)
+	}
+}
+
+func (L *LFU) PromoteIfExistMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.age()
+	for _, key := range keys {
+		if e, ok := L.index[key]; ok {
+			L.increment(e)
+		}
+	}
+}
+
+func (L *LFU) Evict(key string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	if e, ok := L.index[key]; ok {
+		L.remove(e)
+	}
+}
+
+func (L *LFU) EvictMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := L.index[key]; ok {
+			L.remove(e)
+		}
+	}
+}
+
+func (L *LFU) Ban(key string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	if e, ok := L.index[key]; ok {
+		L.remove(e)
+	}
+	L.banned[key] = struct{}{}
+}
+
+func (L *LFU) NowEvict() (key string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	return L.nowEvict()
+}
+
+func (L *LFU) AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	return admitEach(keys, full, evicted, func(key string) string {
+		return L.nowEvict()
+	})
+}
+
+func (L *LFU) nowEvict() (key string) {
+	L.age()
+	front := L.buckets.Front()
+	if front == nil {
+		return ""
+	}
+	e := front.Value.(*lfuBucket).entries.Back().Value.(*lfuEntry)
+	L.remove(e)
+	return e.key
+}
+
+func (L *LFU) Reset() {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.buckets.Init()
+	L.index = make(map[string]*lfuEntry)
+}
+
+func (L *LFU) Keys() []string {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	keys := make([]string, 0, len(L.index))
+	for b := L.buckets.Front(); b != nil; b = b.Next() {
+		for e := b.Value.(*lfuBucket).entries.Back(); e != nil; e = e.Prev() {
+			keys = append(keys, e.Value.(*lfuEntry).key)
+		}
+	}
+	return keys
+}
+
+// increment moves e into the bucket of the next frequency.
+func (L *LFU) increment(e *lfuEntry) {
+	cur := e.bucket
+	freq := cur.Value.(*lfuBucket).freq + 1
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != freq {
+		next = L.buckets.InsertAfter(&lfuBucket{freq: freq, entries: list.New()}, cur)
+	}
+	L.unlink(e)
+	e.bucket = next
+	e.elem = next.Value.(*lfuBucket).entries.PushFront(e)
+}
+
+func (L *LFU) remove(e *lfuEntry) {
+	L.unlink(e)
+	delete(L.index, e.key)
+}
+
+// unlink removes e from its bucket, and drops the bucket once it's empty.
+func (L *LFU) unlink(e *lfuEntry) {
+	b := e.bucket.Value.(*lfuBucket)
+	b.entries.Remove(e.elem)
+	if b.entries.Len() == 0 {
+		L.buckets.Remove(e.bucket)
+	}
+}
+
+// age halves every frequency once agingInterval has passed since the last
+// aging. Buckets that end up with the same frequency are merged, the entries
+// coming from the hotter bucket are kept as the more recent ones.
+func (L *LFU) age() {
+	if L.agingInterval <= 0 {
+		return
+	}
+	now := L.clock.Now()
+	if now.Sub(L.lastAged) < L.agingInterval {
+		return
+	}
+	L.lastAged = now
+	var prev *list.Element
+	for cur := L.buckets.Front(); cur != nil; {
+		next := cur.Next()
+		b := cur.Value.(*lfuBucket)
+		b.freq /= 2
+		if b.freq < 1 {
+			b.freq = 1
+		}
+		if prev != nil && prev.Value.(*lfuBucket).freq == b.freq {
+			pb := prev.Value.(*lfuBucket)
+			for el := b.entries.Back(); el != nil; el = el.Prev() {
+				e := el.Value.(*lfuEntry)
+				e.bucket = prev
+				e.elem = pb.entries.PushFront(e)
+			}
+			L.buckets.Remove(cur)
+		} else {
+			prev = cur
+		}
+		cur = next
+	}
+}
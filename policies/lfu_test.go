@@ -0,0 +1,52 @@
+package policies
+
+import (
+	"m_cache/clock"
+	"testing"
+	"time"
+)
+
+func TestLFU(t *testing.T) {
+	l := NewLFU(3)
+	l.Promote("a")
+	l.Promote("b")
+	l.Promote("c")
+	l.PromoteIfExist("a")
+	l.PromoteIfExist("a")
+	l.PromoteIfExist("c")
+
+	if k := l.NowEvict(); k != "b" {
+		t.Error("expected b to be evicted first, got", k)
+	}
+	if k := l.NowEvict(); k != "c" {
+		t.Error("expected c to be evicted second, got", k)
+	}
+
+	l.Ban("d")
+	l.Promote("d")
+	if k := l.NowEvict(); k != "a" {
+		t.Error("expected a to be evicted, got", k)
+	}
+	if k := l.NowEvict(); k != "" {
+		t.Error("banned key should not be promoted, got", k)
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	clk := clock.NewFakeClock(time.Now())
+	l := NewLFUWithAgingClock(3, 50*time.Millisecond, clk)
+	l.Promote("hot")
+	for i := 0; i < 7; i++ {
+		l.PromoteIfExist("hot")
+	}
+	// three agings bring hot from 8 down to 1
+	for i := 0; i < 3; i++ {
+		clk.Advance(60 * time.Millisecond)
+		l.PromoteIfExist("none")
+	}
+	l.Promote("new")
+	l.PromoteIfExist("new")
+	if k := l.NowEvict(); k != "hot" {
+		t.Error("expected the aged hot key to be evicted, got", k)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"sync/atomic"
 )
 
+// LRU evicts the least recently used key. Every key is indexed by its list
+// element so that all operations are O(1).
 type LRU struct {
 	maxCap       int64
 	pendingQueue *list.List
+	index        map[string]*list.Element
 	mu           sync.Mutex
 }
 
@@ -16,6 +19,7 @@ func NewLRU(maxCap int64) *LRU {
 	return &LRU{
 		maxCap:       maxCap,
 		pendingQueue: list.New(),
+		index:        make(map[string]*list.Element),
 	}
 }
 
@@ -30,35 +34,63 @@ func (L *LRU) Capacity() int64 {
 func (L *LRU) Promote(key string) {
 	L.mu.Lock()
 	defer L.mu.Unlock()
-	var e *list.Element
-	for e = L.pendingQueue.Front(); e != nil && e.Value.(string) != key; e = e.Next() {
+	L.promote(key)
+}
+
+func (L *LRU) PromoteMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	for _, key := range keys {
+		L.promote(key)
 	}
-	if e != nil && e.Value.(string) == key {
-		L.pendingQueue.Remove(e)
+}
+
+func (L *LRU) promote(key string) {
+	if e, ok := L.index[key]; ok {
+		L.pendingQueue.MoveToFront(e)
+		return
 	}
-	L.pendingQueue.PushFront(key)
+	L.index[key] = L.pendingQueue.PushFront(key)
 }
 
 func (L *LRU) PromoteIfExist(key string) {
 	L.mu.Lock()
 	defer L.mu.Unlock()
-	var e *list.Element
-	for e = L.pendingQueue.Front(); e != nil && e.Value.(string) != key; e = e.Next() {
+	L.promoteIfExist(key)
+}
+
+func (L *LRU) PromoteIfExistMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	for _, key := range keys {
+		L.promoteIfExist(key)
 	}
-	if e != nil && e.Value.(string) == key {
-		L.pendingQueue.Remove(e)
-		L.pendingQueue.PushFront(key)
+}
+
+func (L *LRU) promoteIfExist(key string) {
+	if e, ok := L.index[key]; ok {
+		L.pendingQueue.MoveToFront(e)
 	}
 }
 
 func (L *LRU) Evict(key string) {
 	L.mu.Lock()
 	defer L.mu.Unlock()
-	var e *list.Element
-	for e = L.pendingQueue.Front(); e != nil && e.Value.(string) != key; e = e.Next() {
+	L.evict(key)
+}
+
+func (L *LRU) EvictMulti(keys []string) {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	for _, key := range keys {
+		L.evict(key)
 	}
-	if e != nil && e.Value.(string) == key {
+}
+
+func (L *LRU) evict(key string) {
+	if e, ok := L.index[key]; ok {
 		L.pendingQueue.Remove(e)
+		delete(L.index, key)
 	}
 }
 
@@ -66,13 +98,44 @@ func (L *LRU) Ban(key string) {
 	L.Evict(key)
 }
 
+func (L *LRU) Reset() {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.pendingQueue.Init()
+	L.index = make(map[string]*list.Element)
+}
+
+func (L *LRU) Keys() []string {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	keys := make([]string, 0, L.pendingQueue.Len())
+	for e := L.pendingQueue.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
 func (L *LRU) NowEvict() (key string) {
 	L.mu.Lock()
 	defer L.mu.Unlock()
+	return L.nowEvict()
+}
+
+func (L *LRU) AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	return admitEach(keys, full, evicted, func(key string) string {
+		return L.nowEvict()
+	})
+}
+
+func (L *LRU) nowEvict() (key string) {
 	e := L.pendingQueue.Back()
 	if e != nil {
 		L.pendingQueue.Remove(e)
-		return e.Value.(string)
+		key = e.Value.(string)
+		delete(L.index, key)
+		return key
 	}
 	return ""
 }
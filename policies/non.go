@@ -32,3 +32,21 @@ func (n *Non) Ban(key string) {
 func (n *Non) NowEvict() (key string) {
 	return ""
 }
+
+func (n *Non) Reset() {
+}
+
+func (n *Non) PromoteMulti(keys []string) {
+}
+
+func (n *Non) PromoteIfExistMulti(keys []string) {
+}
+
+func (n *Non) EvictMulti(keys []string) {
+}
+
+func (n *Non) AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	return admitEach(keys, full, evicted, func(key string) string {
+		return ""
+	})
+}
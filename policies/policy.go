@@ -16,3 +16,112 @@ type EvictionPolicy interface {
 	// NowEvict evict the 'm-cache key' and return it by eviction policy
 	NowEvict() (key string)
 }
+
+// AdmissionPolicy is an EvictionPolicy which may refuse a new 'm-cache key' instead of making room for it.
+type AdmissionPolicy interface {
+	EvictionPolicy
+	// Admit is called when the m-cache is full before the 'm-cache key' is added. It evicts and returns the victim
+	// chosen to make room, which is the 'm-cache key' itself if it is refused.
+	Admit(key string) (victim string)
+}
+
+// OrderedPolicy is an EvictionPolicy which can list the 'm-cache keys' it tracks, so that their order can be saved
+// and restored by promoting them again in the same order.
+type OrderedPolicy interface {
+	EvictionPolicy
+	// Keys returns the tracked 'm-cache keys', from the next to be evicted to the last one.
+	Keys() []string
+}
+
+// Resetter is an EvictionPolicy which can forget all the 'm-cache keys' it tracks at once. Banned 'm-cache keys'
+// stay banned.
+type Resetter interface {
+	EvictionPolicy
+	// Reset forgets all the 'm-cache keys', as if they had all been evicted.
+	Reset()
+}
+
+// BatchPolicy is an EvictionPolicy which can update several 'm-cache keys' in a single critical section.
+type BatchPolicy interface {
+	EvictionPolicy
+	// PromoteMulti promotes the 'm-cache keys' in order, like Promote.
+	PromoteMulti(keys []string)
+	// PromoteIfExistMulti promotes the existing 'm-cache keys' in order, like PromoteIfExist.
+	PromoteIfExistMulti(keys []string)
+	// EvictMulti evicts the 'm-cache keys', like Evict.
+	EvictMulti(keys []string)
+	// AdmitMulti makes room for the 'm-cache keys' in order. full is called for every key until it returns false,
+	// and must then count the room taken by the key, which is admitted. Meanwhile, victims are evicted like NowEvict,
+	// or like Admit for the keys not tracked yet by an AdmissionPolicy, and passed to evicted. A key is refused when
+	// the policy refuses it or has nothing left to evict. AdmitMulti returns the admitted keys, in order.
+	AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) (admitted []string)
+}
+
+// PromoteMulti promotes the 'm-cache keys' with p, at once if p is a BatchPolicy.
+func PromoteMulti(p EvictionPolicy, keys []string) {
+	if bp, ok := p.(BatchPolicy); ok {
+		bp.PromoteMulti(keys)
+		return
+	}
+	for _, key := range keys {
+		p.Promote(key)
+	}
+}
+
+// PromoteIfExistMulti promotes the existing 'm-cache keys' with p, at once if p is a BatchPolicy.
+func PromoteIfExistMulti(p EvictionPolicy, keys []string) {
+	if bp, ok := p.(BatchPolicy); ok {
+		bp.PromoteIfExistMulti(keys)
+		return
+	}
+	for _, key := range keys {
+		p.PromoteIfExist(key)
+	}
+}
+
+// AdmitMulti makes room for the 'm-cache keys' with p, at once if p is a BatchPolicy. Otherwise the victims are
+// chosen one at a time, by Admit for every key if p is an AdmissionPolicy.
+func AdmitMulti(p EvictionPolicy, keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	if bp, ok := p.(BatchPolicy); ok {
+		return bp.AdmitMulti(keys, full, evicted)
+	}
+	next := func(key string) string {
+		return p.NowEvict()
+	}
+	if ap, ok := p.(AdmissionPolicy); ok {
+		next = ap.Admit
+	}
+	return admitEach(keys, full, evicted, next)
+}
+
+// admitEach is the loop of AdmitMulti, next returns the victim evicted to make room for key, key itself if it's
+// refused or "" if nothing is left to evict.
+func admitEach(keys []string, full func(key string) bool, evicted func(victim string), next func(key string) string) []string {
+	admitted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		refused := false
+		for full(key) {
+			victim := next(key)
+			if victim == "" || victim == key {
+				refused = true
+				break
+			}
+			evicted(victim)
+		}
+		if !refused {
+			admitted = append(admitted, key)
+		}
+	}
+	return admitted
+}
+
+// EvictMulti evicts the 'm-cache keys' with p, at once if p is a BatchPolicy.
+func EvictMulti(p EvictionPolicy, keys []string) {
+	if bp, ok := p.(BatchPolicy); ok {
+		bp.EvictMulti(keys)
+		return
+	}
+	for _, key := range keys {
+		p.Evict(key)
+	}
+}
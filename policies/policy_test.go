@@ -0,0 +1,38 @@
+package policies
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdmitMulti(t *testing.T) {
+	l := NewLRU(3)
+	l.PromoteMulti([]string{"a", "b", "c"})
+	size := 3
+	full := func(key string) bool {
+		if size >= 3 {
+			return true
+		}
+		size++
+		return false
+	}
+	var victims []string
+	evicted := func(victim string) {
+		victims = append(victims, victim)
+		size--
+	}
+	admitted := AdmitMulti(l, []string{"d", "e"}, full, evicted)
+	if !reflect.DeepEqual(admitted, []string{"d", "e"}) || !reflect.DeepEqual(victims, []string{"a", "b"}) {
+		t.Error("unexpected admissions:", admitted, victims)
+	}
+	if keys := l.Keys(); !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Error("the victims are still tracked:", keys)
+	}
+
+	// Non has nothing to evict, the keys which don't fit are refused
+	victims = nil
+	size = 2
+	if admitted := AdmitMulti(NewNon(), []string{"d", "e"}, full, evicted); !reflect.DeepEqual(admitted, []string{"d"}) || victims != nil {
+		t.Error("unexpected admissions:", admitted, victims)
+	}
+}
@@ -0,0 +1,82 @@
+package policies
+
+import "hash/fnv"
+
+const (
+	cmDepth      = 4
+	cmMaxCounter = 15
+)
+
+// cmSketch is a count-min sketch of saturating 4-bit counters. It estimates
+// how often a key has been seen, and halves all counters every sampleSize
+// additions so that old popularity fades out.
+type cmSketch struct {
+	rows       [cmDepth][]uint8
+	seeds      [cmDepth]uint64
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCMSketch(capacity int64) *cmSketch {
+	width := uint64(16)
+	for width < uint64(capacity) {
+		width <<= 1
+	}
+	s := &cmSketch{
+		mask:       width - 1,
+		seeds:      [cmDepth]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325},
+		sampleSize: 10 * int(width),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *cmSketch) index(h uint64, i int) uint64 {
+	x := (h + s.seeds[i]) * 0x9e3779b97f4a7c15
+	return (x ^ x>>32) & s.mask
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// Increment records an occurrence of key.
+func (s *cmSketch) Increment(key string) {
+	h := hashKey(key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < cmMaxCounter {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// Estimate returns the estimated frequency of key.
+func (s *cmSketch) Estimate(key string) uint8 {
+	h := hashKey(key)
+	min := uint8(cmMaxCounter)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (s *cmSketch) reset() {
+	s.additions /= 2
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+}
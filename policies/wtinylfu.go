@@ -0,0 +1,320 @@
+package policies
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	windowPercent    = 1
+	protectedPercent = 80
+)
+
+const (
+	inWindow = iota
+	inProbation
+	inProtected
+)
+
+// WTinyLFU is the W-TinyLFU policy: new keys enter a small window LRU, and
+// keys leaving it have to beat the victim of the segmented main LRU on their
+// estimated frequency to be admitted.
+type WTinyLFU struct {
+	maxCap       int64
+	windowCap    int
+	protectedCap int
+
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	index     map[string]*list.Element
+	banned    map[string]struct{}
+	sketch    *cmSketch
+	mu        sync.Mutex
+}
+
+type wtinylfuEntry struct {
+	key     string
+	segment int
+}
+
+func NewWTinyLFU(maxCap int64) *WTinyLFU {
+	w := &WTinyLFU{
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		index:     make(map[string]*list.Element),
+		banned:    make(map[string]struct{}),
+	}
+	w.setCapacity(maxCap)
+	return w
+}
+
+func (w *WTinyLFU) setCapacity(capacity int64) {
+	w.maxCap = capacity
+	// like Caffeine, any cache of 2 keys or more has a window, otherwise new
+	// keys would have to beat the main victim right away
+	w.windowCap = int(capacity * windowPercent / 100)
+	if w.windowCap < 1 && capacity >= 2 {
+		w.windowCap = 1
+	}
+	w.protectedCap = int((capacity - int64(w.windowCap)) * protectedPercent / 100)
+	w.sketch = newCMSketch(capacity)
+}
+
+// SetCapacity resizes the segments, the frequency sketch starts over.
+func (w *WTinyLFU) SetCapacity(capacity int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.setCapacity(capacity)
+}
+
+func (w *WTinyLFU) Capacity() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.maxCap
+}
+
+func (w *WTinyLFU) Promote(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.promote(key)
+}
+
+func (w *WTinyLFU) PromoteMulti(keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		w.promote(key)
+	}
+}
+
+func (w *WTinyLFU) promote(key string) {
+	if _, ok := w.banned[key]; ok {
+		return
+	}
+	w.sketch.Increment(key)
+	if e, ok := w.index[key]; ok {
+		w.hit(e)
+		return
+	}
+	w.index[key] = w.window.PushFront(&wtinylfuEntry{key: key, segment: inWindow})
+	// keys leaving the window go on probation, main is brought back to size
+	// by the next Admit or NowEvict
+	for w.window.Len() > w.windowCap {
+		e := w.window.Back()
+		w.move(e, w.probation, inProbation)
+	}
+}
+
+// PromoteIfExist promotes the 'm-cache key' if it exists, the access is
+// recorded in the frequency sketch either way.
+func (w *WTinyLFU) PromoteIfExist(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.promoteIfExist(key)
+}
+
+func (w *WTinyLFU) PromoteIfExistMulti(keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		w.promoteIfExist(key)
+	}
+}
+
+func (w *WTinyLFU) promoteIfExist(key string) {
+	w.sketch.Increment(key)
+	if e, ok := w.index[key]; ok {
+		w.hit(e)
+	}
+}
+
+func (w *WTinyLFU) Evict(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.index[key]; ok {
+		w.remove(e)
+	}
+}
+
+func (w *WTinyLFU) EvictMulti(keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := w.index[key]; ok {
+			w.remove(e)
+		}
+	}
+}
+
+func (w *WTinyLFU) Ban(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.index[key]; ok {
+		w.remove(e)
+	}
+	w.banned[key] = struct{}{}
+}
+
+// NowEvict evicts whichever of the window and main victims is less frequent.
+func (w *WTinyLFU) NowEvict() (key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nowEvict()
+}
+
+func (w *WTinyLFU) nowEvict() (key string) {
+	candidate, victim := w.window.Back(), w.mainVictim()
+	switch {
+	case candidate == nil && victim == nil:
+		return ""
+	case candidate == nil:
+		return w.remove(victim)
+	case victim == nil:
+		return w.remove(candidate)
+	}
+	if w.sketch.Estimate(keyOf(candidate)) > w.sketch.Estimate(keyOf(victim)) {
+		return w.remove(victim)
+	}
+	return w.remove(candidate)
+}
+
+// Admit makes room for key. The window's least recent key competes with the
+// main victim, the less frequent of the two is evicted. With a capacity of 1
+// there is no window, key itself competes with the main victim and is
+// refused if it loses. The access to a refused key is recorded right away,
+// the one to an admitted key once it's promoted.
+func (w *WTinyLFU) Admit(key string) (victim string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.admitKey(key)
+}
+
+// AdmitMulti admits the keys not tracked yet like Admit, and makes room for
+// the others like NowEvict.
+func (w *WTinyLFU) AdmitMulti(keys []string, full func(key string) bool, evicted func(victim string)) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return admitEach(keys, full, evicted, func(key string) string {
+		if _, ok := w.index[key]; ok {
+			return w.nowEvict()
+		}
+		return w.admitKey(key)
+	})
+}
+
+func (w *WTinyLFU) admitKey(key string) (victim string) {
+	if victim = w.admit(key); victim == key || victim == "" {
+		// key isn't promoted
+		w.sketch.Increment(key)
+	}
+	return victim
+}
+
+func (w *WTinyLFU) admit(key string) (victim string) {
+	if _, ok := w.banned[key]; ok {
+		return key
+	}
+	main := w.mainVictim()
+	if w.windowCap == 0 {
+		if main == nil {
+			return ""
+		}
+		// counting the access to key, which isn't recorded yet
+		if w.sketch.Estimate(key)+1 <= w.sketch.Estimate(keyOf(main)) {
+			return key
+		}
+		return w.remove(main)
+	}
+	candidate := w.window.Back()
+	if w.window.Len() < w.windowCap || candidate == nil {
+		if main == nil {
+			return ""
+		}
+		return w.remove(main)
+	}
+	if main != nil && w.sketch.Estimate(keyOf(candidate)) > w.sketch.Estimate(keyOf(main)) {
+		victim = w.remove(main)
+		w.move(candidate, w.probation, inProbation)
+		return victim
+	}
+	return w.remove(candidate)
+}
+
+// Reset forgets the keys along with their frequencies.
+func (w *WTinyLFU) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.window.Init()
+	w.probation.Init()
+	w.protected.Init()
+	w.index = make(map[string]*list.Element)
+	w.setCapacity(w.maxCap)
+}
+
+// Keys lists the keys on probation first, then the protected ones and the
+// window last.
+func (w *WTinyLFU) Keys() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	keys := make([]string, 0, len(w.index))
+	for _, l := range []*list.List{w.probation, w.protected, w.window} {
+		for e := l.Back(); e != nil; e = e.Prev() {
+			keys = append(keys, keyOf(e))
+		}
+	}
+	return keys
+}
+
+// hit moves e to the front of its segment, keys hit on probation are
+// promoted to the protected segment.
+func (w *WTinyLFU) hit(e *list.Element) {
+	switch e.Value.(*wtinylfuEntry).segment {
+	case inWindow:
+		w.window.MoveToFront(e)
+	case inProtected:
+		w.protected.MoveToFront(e)
+	case inProbation:
+		w.move(e, w.protected, inProtected)
+		for w.protected.Len() > w.protectedCap {
+			w.move(w.protected.Back(), w.probation, inProbation)
+		}
+	}
+}
+
+func (w *WTinyLFU) mainVictim() *list.Element {
+	if e := w.probation.Back(); e != nil {
+		return e
+	}
+	return w.protected.Back()
+}
+
+func (w *WTinyLFU) segment(e *list.Element) *list.List {
+	switch e.Value.(*wtinylfuEntry).segment {
+	case inWindow:
+		return w.window
+	case inProbation:
+		return w.probation
+	default:
+		return w.protected
+	}
+}
+
+func (w *WTinyLFU) move(e *list.Element, to *list.List, segment int) {
+	entry := e.Value.(*wtinylfuEntry)
+	w.segment(e).Remove(e)
+	entry.segment = segment
+	w.index[entry.key] = to.PushFront(entry)
+}
+
+func (w *WTinyLFU) remove(e *list.Element) string {
+	entry := e.Value.(*wtinylfuEntry)
+	w.segment(e).Remove(e)
+	delete(w.index, entry.key)
+	return entry.key
+}
+
+func keyOf(e *list.Element) string {
+	return e.Value.(*wtinylfuEntry).key
+}
@@ -0,0 +1,110 @@
+package policies
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestWTinyLFUScan(t *testing.T) {
+	w := NewWTinyLFU(200)
+	var resident int
+	add := func(k string) {
+		if resident >= 200 {
+			if victim := w.Admit(k); victim == k {
+				return
+			}
+			resident--
+		}
+		w.Promote(k)
+		resident++
+	}
+	for i := 0; i < 100; i++ {
+		add("hot" + strconv.Itoa(i))
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			w.PromoteIfExist("hot" + strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		add("scan" + strconv.Itoa(i))
+	}
+	// the sketch may overestimate a few scanned keys, but the hot set must
+	// survive as a whole
+	var survived int
+	for i := 0; i < 100; i++ {
+		if _, ok := w.index["hot"+strconv.Itoa(i)]; ok {
+			survived++
+		}
+	}
+	if survived < 95 {
+		t.Error("hot keys were evicted by the scan, survived:", survived)
+	}
+}
+
+func TestWTinyLFURejects(t *testing.T) {
+	// a single key leaves no room for a window, new keys compete with the
+	// main victim directly
+	w := NewWTinyLFU(1)
+	w.Promote("a")
+	w.PromoteIfExist("a")
+	if victim := w.Admit("c"); victim != "c" {
+		t.Error("cold key should be refused, evicted", victim)
+	}
+	w.PromoteIfExist("c")
+	w.PromoteIfExist("c")
+	w.PromoteIfExist("c")
+	if victim := w.Admit("c"); victim == "c" || victim == "" {
+		t.Error("frequent key should be admitted, got victim", victim)
+	}
+}
+
+func TestWTinyLFUSmallWindow(t *testing.T) {
+	w := NewWTinyLFU(50)
+	for i := 0; i < 50; i++ {
+		w.Promote("old" + strconv.Itoa(i))
+	}
+	for i := 0; i < 20; i++ {
+		k := "new" + strconv.Itoa(i)
+		if victim := w.Admit(k); victim == k || victim == "" {
+			t.Fatal("a fresh key should go through the window, got victim", victim)
+		}
+		w.Promote(k)
+		// the access is recorded by Promote only
+		if n := w.sketch.Estimate(k); n != 1 {
+			t.Error("expected", k, "to be counted once, got", n)
+		}
+	}
+}
+
+func TestWTinyLFUAdmitBatch(t *testing.T) {
+	w := NewWTinyLFU(50)
+	for i := 0; i < 50; i++ {
+		w.Promote("old" + strconv.Itoa(i))
+	}
+	// the sketch may already count some of the keys through collisions
+	keys := []string{"n0", "n1", "n2", "n3"}
+	before := make(map[string]int, len(keys))
+	for _, k := range keys {
+		before[k] = int(w.sketch.Estimate(k))
+	}
+	for _, k := range keys {
+		if victim := w.Admit(k); victim == k || victim == "" {
+			t.Fatal("a fresh key should go through the window, got victim", victim)
+		}
+	}
+	// n3 is admitted but never promoted
+	w.PromoteMulti(keys[:3])
+	for _, k := range keys[:3] {
+		if n := int(w.sketch.Estimate(k)); n != before[k]+1 {
+			t.Error("expected", k, "to be counted once, got", n-before[k])
+		}
+	}
+	if n := int(w.sketch.Estimate("n3")); n != before["n3"] {
+		t.Error("n3 was counted without being promoted")
+	}
+	w.Promote("n3")
+	if n := int(w.sketch.Estimate("n3")); n != before["n3"]+1 {
+		t.Error("expected n3 to be counted once, got", n-before["n3"])
+	}
+}
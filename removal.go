@@ -0,0 +1,93 @@
+package m_cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RemovalReason tells why an item left the m-cache.
+type RemovalReason int
+
+const (
+	// Expired items reached their expiration time.
+	Expired RemovalReason = iota
+	// Capacity items were evicted by the eviction policy to make room for others.
+	Capacity
+	// Explicit items were removed by Delete or InvalidateTag.
+	Explicit
+	// Replaced items were overwritten by Set or Replace.
+	Replaced
+	// Flushed items were removed along with all the others.
+	Flushed
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Capacity:
+		return "capacity"
+	case Explicit:
+		return "explicit"
+	case Replaced:
+		return "replaced"
+	case Flushed:
+		return "flushed"
+	}
+	return "unknown"
+}
+
+// RemovalEvent describes an item which left the m-cache.
+type RemovalEvent struct {
+	Key string
+	// Value is the value which was removed.
+	Value interface{}
+	// NewValue is the value which replaced Value, only set for Replaced.
+	NewValue interface{}
+	Reason   RemovalReason
+	Time     time.Time
+}
+
+// OnRemoval sets the function called every time an item leaves the m-cache,
+// whatever the reason. It is called synchronously, once the item has been
+// removed and outside of any lock, on the goroutine which removed it: the
+// caller of Set, Add, Replace or Delete, or the time wheel worker running the
+// expiration. A slow function thus slows those down, and it must hand the
+// event over to another goroutine if it needs to call back into the m-cache
+// while keeping the caller fast. It should be set before the m-cache is used.
+func (c *cache) OnRemoval(onRemoval func(RemovalEvent)) {
+	c.onRemoval = onRemoval
+}
+
+// removed does the bookkeeping of an entry removed from the dict and notifies
+// the removal. newValue is only meaningful for Replaced.
+func (c *cache) removed(k string, e *entry, reason RemovalReason, newValue interface{}) {
+	if e.tags != nil {
+		c.tags.remove(e.tags)
+	}
+	c.notify(k, e, reason, newValue)
+}
+
+// replaced is removed for an entry replaced by e, which keeps the tags of
+// old indexed when it carries them on.
+func (c *cache) replaced(k string, old, e *entry) {
+	if old.tags != nil && old.tags != e.tags {
+		c.tags.remove(old.tags)
+	}
+	c.notify(k, old, Replaced, e.value)
+}
+
+func (c *cache) notify(k string, e *entry, reason RemovalReason, newValue interface{}) {
+	atomic.AddInt64(&c.cost, -e.cost)
+	switch reason {
+	case Expired:
+		atomic.AddUint64(&c.stats.expirations, 1)
+	case Capacity:
+		atomic.AddUint64(&c.stats.evictions, 1)
+	case Explicit:
+		atomic.AddUint64(&c.stats.deletes, 1)
+	}
+	if c.onRemoval != nil {
+		c.onRemoval(RemovalEvent{Key: k, Value: e.value, NewValue: newValue, Reason: reason, Time: c.clock.Now()})
+	}
+}
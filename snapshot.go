@@ -0,0 +1,166 @@
+package m_cache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"m_cache/policies"
+	"os"
+	"time"
+)
+
+// Codec encodes the snapshots written by Save and decodes the ones read by Load.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// GobCodec is the default Codec. The concrete types of the stored values
+// which aren't Go basic types must be registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (GobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// JSONCodec writes snapshots as JSON. The values are loaded back as the
+// generic JSON types: float64, string, bool, []interface{} and
+// map[string]interface{}.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+type snapshot struct {
+	// SavedAt is the UnixNano time the snapshot was taken at
+	SavedAt int64
+	// Items are ordered from the next to be evicted to the last one
+	Items []snapshotItem
+}
+
+type snapshotItem struct {
+	Key   string
+	Value interface{}
+	Cost  int64
+	// TTL is the time the item had left to live when the snapshot was taken
+	TTL time.Duration
+	// Sliding is the time the item lives after its last access, 0 if its
+	// expiration doesn't slide
+	Sliding time.Duration
+	Tags    []string
+}
+
+// Save writes all the unexpired items of the m-cache to w, along with their
+// remaining time to live and their order in the eviction policy.
+func (c *cache) Save(w io.Writer) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	now := c.clock.Now()
+	items := make(map[string]*entry)
+	c.items.ForEach(func(k string, v interface{}) bool {
+		items[k] = v.(*entry)
+		return true
+	})
+
+	s := snapshot{SavedAt: now.UnixNano(), Items: make([]snapshotItem, 0, len(items))}
+	add := func(k string, e *entry) {
+		ttl := NoExpiration
+		// stale items are saved until the end of their grace period
+		if expiration := e.expiresAt(); expiration > 0 {
+			if ttl = time.Duration(expiration - now.UnixNano()); ttl <= 0 {
+				return
+			}
+		}
+		it := snapshotItem{Key: k, Value: e.value, Cost: e.cost, TTL: ttl, Sliding: e.slides()}
+		if e.tags != nil {
+			it.Tags = e.tags.names
+		}
+		s.Items = append(s.Items, it)
+	}
+	var ordered []string
+	if op, ok := c.policy.(policies.OrderedPolicy); ok {
+		ordered = op.Keys()
+	}
+	// keys unknown to the policy have no order, they are saved as the coldest
+	known := make(map[string]struct{}, len(ordered))
+	for _, k := range ordered {
+		known[k] = struct{}{}
+	}
+	for k, e := range items {
+		if _, ok := known[k]; !ok {
+			add(k, e)
+		}
+	}
+	for _, k := range ordered {
+		if e, ok := items[k]; ok {
+			add(k, e)
+		}
+	}
+	return c.codec.Encode(w, &s)
+}
+
+// Load sets the items read from a snapshot written by Save. Items keep the
+// time they had left to live when saved minus the time elapsed since, the
+// ones which expired meanwhile are skipped. With a refresh loader, the items
+// are stale the grace period before they expire.
+func (c *cache) Load(r io.Reader) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	var s snapshot
+	if err := c.codec.Decode(r, &s); err != nil {
+		return err
+	}
+	now := c.clock.Now()
+	elapsed := now.Sub(time.Unix(0, s.SavedAt))
+	for _, it := range s.Items {
+		if it.TTL == NoExpiration {
+			c.set(it.Key, it.Value, it.Cost, NoExpiration, 0, it.Tags)
+			continue
+		}
+		d := it.TTL - elapsed
+		if d <= 0 {
+			continue
+		}
+		// the TTL already includes the grace period of a refreshed item
+		c.store(it.Key, c.entryExpiringAt(it.Value, it.Cost, now.Add(d).UnixNano(), it.Sliding), it.Tags)
+	}
+	return nil
+}
+
+// SaveFile writes a snapshot of the m-cache to the file at path.
+func (c *cache) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = c.Save(w); err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LoadFile loads a snapshot from the file at path.
+func (c *cache) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Load(bufio.NewReader(f))
+}
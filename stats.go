@@ -0,0 +1,76 @@
+package m_cache
+
+import "sync/atomic"
+
+// Stats is a snapshot of the counters of a Cache.
+type Stats struct {
+	Hits           uint64
+	Misses         uint64
+	Sets           uint64
+	AddsFailed     uint64
+	ReplacesFailed uint64
+	Deletes        uint64
+	// Expirations counts the items removed by the expiration jobs.
+	Expirations uint64
+	// Evictions counts the items evicted to make room for others.
+	Evictions    uint64
+	LoaderCalls  uint64
+	LoaderErrors uint64
+}
+
+// HitRatio returns the ratio of Get calls which found their key.
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// stats holds the counters updated atomically by the m-cache.
+type stats struct {
+	hits           uint64
+	misses         uint64
+	sets           uint64
+	addsFailed     uint64
+	replacesFailed uint64
+	deletes        uint64
+	expirations    uint64
+	evictions      uint64
+	loaderCalls    uint64
+	loaderErrors   uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Hits:           atomic.LoadUint64(&s.hits),
+		Misses:         atomic.LoadUint64(&s.misses),
+		Sets:           atomic.LoadUint64(&s.sets),
+		AddsFailed:     atomic.LoadUint64(&s.addsFailed),
+		ReplacesFailed: atomic.LoadUint64(&s.replacesFailed),
+		Deletes:        atomic.LoadUint64(&s.deletes),
+		Expirations:    atomic.LoadUint64(&s.expirations),
+		Evictions:      atomic.LoadUint64(&s.evictions),
+		LoaderCalls:    atomic.LoadUint64(&s.loaderCalls),
+		LoaderErrors:   atomic.LoadUint64(&s.loaderErrors),
+	}
+}
+
+func (s *stats) reset() {
+	for _, counter := range []*uint64{
+		&s.hits, &s.misses, &s.sets, &s.addsFailed, &s.replacesFailed,
+		&s.deletes, &s.expirations, &s.evictions, &s.loaderCalls, &s.loaderErrors,
+	} {
+		atomic.StoreUint64(counter, 0)
+	}
+}
+
+// Stats returns a snapshot of the counters of the m-cache.
+func (c *cache) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// ResetStats sets all the counters back to zero.
+func (c *cache) ResetStats() {
+	c.stats.reset()
+}
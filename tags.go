@@ -0,0 +1,129 @@
+package m_cache
+
+import (
+	"sync"
+	"time"
+)
+
+// tagSet holds the tags of an entry. The copies of the entry made by in-place
+// updates share it, which is how the tag index recognizes them.
+type tagSet struct {
+	key   string
+	names []string
+}
+
+func newTagSet(k string, names []string) *tagSet {
+	ts := &tagSet{key: k}
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, dup := seen[name]; !dup {
+			seen[name] = struct{}{}
+			ts.names = append(ts.names, name)
+		}
+	}
+	return ts
+}
+
+// tagIndex maps every tag to the tag sets carrying it. A tag set is indexed
+// before its entry is stored and unindexed once the entry is removed, so that
+// replacing an entry never unindexes the one replacing it.
+type tagIndex struct {
+	mu   sync.Mutex
+	tags map[string]map[*tagSet]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{tags: make(map[string]map[*tagSet]struct{})}
+}
+
+func (ti *tagIndex) add(ts *tagSet) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for _, name := range ts.names {
+		sets, ok := ti.tags[name]
+		if !ok {
+			sets = make(map[*tagSet]struct{})
+			ti.tags[name] = sets
+		}
+		sets[ts] = struct{}{}
+	}
+}
+
+func (ti *tagIndex) remove(ts *tagSet) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for _, name := range ts.names {
+		if sets, ok := ti.tags[name]; ok {
+			delete(sets, ts)
+			if len(sets) == 0 {
+				delete(ti.tags, name)
+			}
+		}
+	}
+}
+
+// tagged returns the tag sets carrying the tag.
+func (ti *tagIndex) tagged(name string) []*tagSet {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	sets := make([]*tagSet, 0, len(ti.tags[name]))
+	for ts := range ti.tags[name] {
+		sets = append(sets, ts)
+	}
+	return sets
+}
+
+// SetWithTags sets an item like Set does, and tags it so that it can be
+// removed along with the other items carrying one of its tags by
+// InvalidateTag. Setting the item again without tags removes them, while
+// Replace, CompareAndSwap, Compute, Merge and the numeric operations keep
+// them.
+func (c *cache) SetWithTags(k string, x interface{}, d time.Duration, tags ...string) {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	c.set(k, x, c.costOf(k, x), d, c.slidingOf(d), tags)
+}
+
+// InvalidateTag removes all the items carrying the tag, which are notified
+// with the Explicit reason, and returns how many it removed. Items set with
+// the tag during the call may survive it.
+func (c *cache) InvalidateTag(tag string) int {
+	if c.Closed() {
+		return 0
+	}
+	n := 0
+	for _, ts := range c.tags.tagged(tag) {
+		ts := ts
+		v, removed := c.items.RemoveIf(ts.key, func(v interface{}) bool {
+			return v.(*entry).tags == ts
+		})
+		if !removed {
+			continue
+		}
+		// like CompareAndDelete, the expiration job is left to find nothing
+		c.policy.Evict(ts.key)
+		if e := v.(*entry); e.expired(c.now()) {
+			c.removed(ts.key, e, Expired, nil)
+		} else {
+			c.removed(ts.key, e, Explicit, nil)
+			n++
+		}
+	}
+	return n
+}
+
+// Tags returns the tags of k, and false if k is not in the m-cache.
+func (c *cache) Tags(k string) ([]string, bool) {
+	if c.Closed() {
+		return nil, false
+	}
+	e, found := c.getEntry(k)
+	if !found {
+		return nil, false
+	}
+	if e.tags == nil {
+		return nil, true
+	}
+	return append([]string(nil), e.tags.names...), true
+}
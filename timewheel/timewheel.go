@@ -3,73 +3,155 @@ package timewheel
 import (
 	"container/list"
 	"log"
+	"m_cache/clock"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// TimeWheel can execute job after waiting given duration
+// TimeWheel can execute job after waiting given duration.
+//
+// It is a hierarchical timing wheel: the first level has slotNum slots of one
+// interval each, and every other level has slotNum slots spanning a whole
+// revolution of the level below it. Levels are added as longer delays come
+// in. A job is put in the lowest level able to hold its delay, and moves down
+// one level each time the slot it's in comes up, so adding a job is O(1) and
+// far-future jobs are only touched once per level.
 type TimeWheel struct {
+	// pending is the number of jobs waiting in the slots, updated atomically
+	pending  int64
 	interval time.Duration
-	ticker   *time.Ticker
-	slots    []*list.List
+	clock    clock.Clock
+	ticker   clock.Ticker
+	slotNum  int
+	levels   []*level
+	// ticks is the number of intervals elapsed since the start
+	ticks int64
 
-	timer             map[string]int
-	currentPos        int
-	slotNum           int
-	addTaskChannel    chan task
-	removeTaskChannel chan string
-	stopChannel       chan bool
+	timer              map[string]*list.Element
+	addTaskChannel     chan task
+	addTasksChannel    chan []task
+	removeTaskChannel  chan string
+	removeTasksChannel chan []string
+	clearChannel       chan struct{}
+	stopChannel        chan struct{}
+	stopOnce           sync.Once
+	// done is closed once the worker goroutine has returned
+	done chan struct{}
+	// jobs tracks the running jobs
+	jobs sync.WaitGroup
+}
+
+type level struct {
+	// span is the number of ticks covered by a slot of the level
+	span  int64
+	slots []*list.List
+}
+
+// Job is a job added along with others by AddJobs.
+type Job struct {
+	Key   string
+	Delay time.Duration
+	Job   func()
 }
 
 type task struct {
-	delay  time.Duration
-	circle int
-	key    string
-	job    func()
+	// expiration is the tick the job runs at
+	expiration int64
+	delay      time.Duration
+	key        string
+	job        func()
+	slot       *list.List
 }
 
 // New creates a new time wheel
 func New(interval time.Duration, slotNum int) *TimeWheel {
-	if interval <= 0 || slotNum <= 0 {
+	return NewWithClock(interval, slotNum, clock.Real)
+}
+
+// NewWithClock creates a new time wheel ticking on the given clock
+func NewWithClock(interval time.Duration, slotNum int, clk clock.Clock) *TimeWheel {
+	if interval <= 0 || slotNum <= 1 {
 		return nil
 	}
 	tw := &TimeWheel{
-		interval:          interval,
-		slots:             make([]*list.List, slotNum),
-		timer:             make(map[string]int),
-		currentPos:        0,
-		slotNum:           slotNum,
-		addTaskChannel:    make(chan task),
-		removeTaskChannel: make(chan string),
-		stopChannel:       make(chan bool),
+		interval:           interval,
+		clock:              clk,
+		slotNum:            slotNum,
+		timer:              make(map[string]*list.Element),
+		addTaskChannel:     make(chan task),
+		addTasksChannel:    make(chan []task),
+		removeTaskChannel:  make(chan string),
+		removeTasksChannel: make(chan []string),
+		clearChannel:       make(chan struct{}),
+		stopChannel:        make(chan struct{}),
+		done:               make(chan struct{}),
 	}
-	tw.initSlots()
+	tw.addLevel()
 
 	return tw
 }
 
-func (tw *TimeWheel) initSlots() {
-	for i := 0; i < tw.slotNum; i++ {
-		tw.slots[i] = list.New()
+func (tw *TimeWheel) addLevel() {
+	span := int64(1)
+	if n := len(tw.levels); n > 0 {
+		span = tw.levels[n-1].span * int64(tw.slotNum)
+	}
+	l := &level{span: span, slots: make([]*list.List, tw.slotNum)}
+	for i := range l.slots {
+		l.slots[i] = list.New()
 	}
+	tw.levels = append(tw.levels, l)
 }
 
 // Start starts ticker for time wheel
 func (tw *TimeWheel) Start() {
-	tw.ticker = time.NewTicker(tw.interval)
+	tw.ticker = tw.clock.NewTicker(tw.interval)
 	go tw.start()
 }
 
-// Stop stops the time wheel
+// Stop stops the time wheel and waits for the running jobs to return, the
+// pending ones are dropped. It can be called several times, and jobs added
+// or removed afterwards are ignored. It must not be called from a job.
 func (tw *TimeWheel) Stop() {
-	tw.stopChannel <- true
+	started := tw.ticker != nil
+	tw.stopOnce.Do(func() {
+		close(tw.stopChannel)
+	})
+	if started {
+		<-tw.done
+	}
+	tw.jobs.Wait()
 }
 
-// AddJob add new job into pending queue
+// AddJob add new job into pending queue, a pending job of the same key is
+// replaced
 func (tw *TimeWheel) AddJob(key string, delay time.Duration, job func()) {
 	if delay < 0 {
 		return
 	}
-	tw.addTaskChannel <- task{delay: delay, key: key, job: job}
+	select {
+	case tw.addTaskChannel <- task{delay: delay, key: key, job: job}:
+	case <-tw.stopChannel:
+	}
+}
+
+// AddJobs adds the jobs in a single message to the time wheel, like AddJob
+// does for each of them
+func (tw *TimeWheel) AddJobs(jobs []Job) {
+	tasks := make([]task, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Delay >= 0 {
+			tasks = append(tasks, task{delay: job.Delay, key: job.Key, job: job.Job})
+		}
+	}
+	if len(tasks) == 0 {
+		return
+	}
+	select {
+	case tw.addTasksChannel <- tasks:
+	case <-tw.stopChannel:
+	}
 }
 
 // RemoveJob add remove job from pending queue
@@ -78,45 +160,95 @@ func (tw *TimeWheel) RemoveJob(key string) {
 	if key == "" {
 		return
 	}
-	tw.removeTaskChannel <- key
+	select {
+	case tw.removeTaskChannel <- key:
+	case <-tw.stopChannel:
+	}
+}
+
+// RemoveJobs removes the jobs of the keys in a single message to the time
+// wheel, like RemoveJob does for each of them
+func (tw *TimeWheel) RemoveJobs(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	select {
+	case tw.removeTasksChannel <- keys:
+	case <-tw.stopChannel:
+	}
+}
+
+// Clear removes all the pending jobs, the running ones aren't waited for
+func (tw *TimeWheel) Clear() {
+	select {
+	case tw.clearChannel <- struct{}{}:
+	case <-tw.stopChannel:
+	}
+}
+
+// Len returns the number of jobs waiting to be run
+func (tw *TimeWheel) Len() int {
+	return int(atomic.LoadInt64(&tw.pending))
 }
 
 func (tw *TimeWheel) start() {
+	defer close(tw.done)
 	for {
 		select {
-		case <-tw.ticker.C:
+		case <-tw.ticker.C():
 			tw.tickHandler()
 		case task := <-tw.addTaskChannel:
 			tw.addTask(&task)
+		case tasks := <-tw.addTasksChannel:
+			for i := range tasks {
+				tw.addTask(&tasks[i])
+			}
 		case key := <-tw.removeTaskChannel:
 			tw.removeTask(key)
+		case keys := <-tw.removeTasksChannel:
+			for _, key := range keys {
+				tw.removeTask(key)
+			}
+		case <-tw.clearChannel:
+			tw.clear()
 		case <-tw.stopChannel:
 			tw.ticker.Stop()
+			atomic.StoreInt64(&tw.pending, 0)
 			return
 		}
 	}
 }
 
+// tickHandler moves the wheel one interval forward: the slots of the upper
+// levels starting now are cascaded down, then the jobs of the current slot
+// of the first level are run.
 func (tw *TimeWheel) tickHandler() {
-	l := tw.slots[tw.currentPos]
-	tw.scanAndRunTask(l)
-	if tw.currentPos == tw.slotNum-1 {
-		tw.currentPos = 0
-	} else {
-		tw.currentPos++
+	tw.ticks++
+	for i := 1; i < len(tw.levels); i++ {
+		l := tw.levels[i]
+		if tw.ticks%l.span != 0 {
+			break
+		}
+		tw.cascade(l.slots[(tw.ticks/l.span)%int64(tw.slotNum)])
 	}
+	tw.runTasks(tw.levels[0].slots[tw.ticks%int64(tw.slotNum)])
 }
 
-func (tw *TimeWheel) scanAndRunTask(l *list.List) {
+func (tw *TimeWheel) cascade(l *list.List) {
 	for e := l.Front(); e != nil; {
-		task := e.Value.(*task)
-		if task.circle > 0 {
-			task.circle--
-			e = e.Next()
-			continue
-		}
+		next := e.Next()
+		task := l.Remove(e).(*task)
+		tw.place(task)
+		e = next
+	}
+}
 
+func (tw *TimeWheel) runTasks(l *list.List) {
+	for e := l.Front(); e != nil; {
+		task := e.Value.(*task)
+		tw.jobs.Add(1)
 		go func() {
+			defer tw.jobs.Done()
 			defer func() {
 				if err := recover(); err != nil {
 					log.Fatalln(err)
@@ -127,6 +259,7 @@ func (tw *TimeWheel) scanAndRunTask(l *list.List) {
 		}()
 		next := e.Next()
 		l.Remove(e)
+		atomic.AddInt64(&tw.pending, -1)
 		if task.key != "" {
 			delete(tw.timer, task.key)
 		}
@@ -135,40 +268,53 @@ func (tw *TimeWheel) scanAndRunTask(l *list.List) {
 }
 
 func (tw *TimeWheel) addTask(task *task) {
-	pos, circle := tw.getPositionAndCircle(task.delay)
-	task.circle = circle
-
-	tw.slots[pos].PushBack(task)
+	ticks := int64(task.delay / tw.interval)
+	if ticks < 1 {
+		ticks = 1
+	}
+	task.expiration = tw.ticks + ticks
+	if task.key != "" {
+		tw.removeTask(task.key)
+	}
+	tw.place(task)
+	atomic.AddInt64(&tw.pending, 1)
+}
 
+// place puts the task in the lowest level whose revolution covers its
+// remaining delay.
+func (tw *TimeWheel) place(task *task) {
+	remaining := task.expiration - tw.ticks
+	i := 0
+	for remaining >= tw.levels[i].span*int64(tw.slotNum) {
+		i++
+		if i == len(tw.levels) {
+			tw.addLevel()
+		}
+	}
+	l := tw.levels[i]
+	task.slot = l.slots[(task.expiration/l.span)%int64(tw.slotNum)]
+	e := task.slot.PushBack(task)
 	if task.key != "" {
-		tw.timer[task.key] = pos
+		tw.timer[task.key] = e
 	}
 }
 
-func (tw *TimeWheel) getPositionAndCircle(d time.Duration) (pos int, circle int) {
-	delaySeconds := int(d.Milliseconds())
-	intervalSeconds := int(tw.interval.Milliseconds())
-	circle = int(delaySeconds / intervalSeconds / tw.slotNum)
-	pos = int(tw.currentPos+delaySeconds/intervalSeconds-1) % tw.slotNum
-	if pos < 0 {
-		pos = 0
+func (tw *TimeWheel) clear() {
+	for _, l := range tw.levels {
+		for _, slot := range l.slots {
+			slot.Init()
+		}
 	}
-	return
+	tw.timer = make(map[string]*list.Element)
+	atomic.StoreInt64(&tw.pending, 0)
 }
 
 func (tw *TimeWheel) removeTask(key string) {
-	position, ok := tw.timer[key]
+	e, ok := tw.timer[key]
 	if !ok {
 		return
 	}
-	l := tw.slots[position]
-	for e := l.Front(); e != nil; {
-		task := e.Value.(*task)
-		if task.key == key {
-			delete(tw.timer, task.key)
-			l.Remove(e)
-		}
-
-		e = e.Next()
-	}
+	e.Value.(*task).slot.Remove(e)
+	delete(tw.timer, key)
+	atomic.AddInt64(&tw.pending, -1)
 }
@@ -0,0 +1,91 @@
+package timewheel
+
+import (
+	"m_cache/clock"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHierarchicalTimeWheel(t *testing.T) {
+	tw := New(time.Millisecond, 8)
+	var runs int32
+	add := func(key string, delay time.Duration) {
+		tw.addTask(&task{key: key, delay: delay, job: func() {
+			atomic.AddInt32(&runs, 1)
+		}})
+	}
+	add("short", 3*time.Millisecond)
+	add("medium", 20*time.Millisecond)
+	add("long", 1000*time.Millisecond)
+	add("replaced", 5*time.Millisecond)
+	add("replaced", 50*time.Millisecond)
+	add("removed", 30*time.Millisecond)
+	tw.removeTask("removed")
+
+	if len(tw.levels) != 4 {
+		t.Error("expected 4 levels for a 1000 ticks delay, got", len(tw.levels))
+	}
+	if tw.Len() != 4 {
+		t.Error("expected 4 pending jobs, got", tw.Len())
+	}
+
+	// a job leaves the timer when it's run
+	ran := make(map[string]int64)
+	for i := 0; i < 1000; i++ {
+		tw.tickHandler()
+		for _, k := range []string{"short", "medium", "long", "replaced"} {
+			if _, ok := tw.timer[k]; !ok && ran[k] == 0 {
+				ran[k] = tw.ticks
+			}
+		}
+	}
+	<-time.After(10 * time.Millisecond)
+
+	expected := map[string]int64{"short": 3, "medium": 20, "replaced": 50, "long": 1000}
+	for k, tick := range expected {
+		if ran[k] != tick {
+			t.Errorf("expected %s to run at tick %d, ran at %d", k, tick, ran[k])
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 4 {
+		t.Error("expected 4 jobs to run, got", n)
+	}
+	if tw.Len() != 0 {
+		t.Error("expected no pending job, got", tw.Len())
+	}
+}
+
+func TestAddJobs(t *testing.T) {
+	clk := clock.NewFakeClock(time.Unix(0, 0))
+	tw := NewWithClock(time.Second, 8, clk)
+	tw.Start()
+	var mu sync.Mutex
+	ran := make(map[string]bool)
+	job := func(key string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			ran[key] = true
+		}
+	}
+	tw.AddJobs([]Job{
+		{Key: "a", Delay: time.Second, Job: job("a")},
+		{Key: "b", Delay: 2 * time.Second, Job: job("b")},
+		{Key: "c", Delay: 3 * time.Second, Job: job("c")},
+		{Key: "d", Delay: -1, Job: job("d")},
+	})
+	tw.RemoveJobs([]string{"b"})
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Second)
+	}
+	tw.Stop()
+
+	if !ran["a"] || !ran["c"] {
+		t.Error("expected a and c to run:", ran)
+	}
+	if ran["b"] || ran["d"] {
+		t.Error("removed and negative delay jobs shouldn't run:", ran)
+	}
+}
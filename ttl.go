@@ -0,0 +1,88 @@
+package m_cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// TTL returns the time k has left to live, NoExpiration if it never
+// expires. It returns false if k is not in the m-cache.
+func (c *cache) TTL(k string) (time.Duration, bool) {
+	if c.Closed() {
+		return 0, false
+	}
+	e, found := c.getEntry(k)
+	if !found {
+		return 0, false
+	}
+	expiration := e.expiresAt()
+	if expiration == 0 {
+		return NoExpiration, true
+	}
+	return time.Duration(expiration - c.now()), true
+}
+
+// Touch makes k expire after d from now without rewriting its value, d
+// follows the same rules as for Set.
+func (c *cache) Touch(k string, d time.Duration) error {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d < 0 {
+		return c.Persist(k)
+	}
+	return c.ExpireAt(k, c.clock.Now().Add(d))
+}
+
+// Persist removes the expiration of k, which no longer slides nor gets
+// stale if it did.
+func (c *cache) Persist(k string) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	e, found := c.getEntry(k)
+	if !found {
+		return fmt.Errorf("item %s doesn't exists", k)
+	}
+	// the pending expiration job finds nothing to do when it runs
+	e.fixExpiration(0)
+	e.setStaleAt(0)
+	return nil
+}
+
+// ExpireAt makes k expire at t, k is removed right away if t has passed.
+// The expiration of k no longer slides if it did.
+func (c *cache) ExpireAt(k string, t time.Time) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	e, found := c.getEntry(k)
+	if !found {
+		return fmt.Errorf("item %s doesn't exists", k)
+	}
+	e.fixExpiration(t.UnixNano())
+	if e.staleAt() > 0 {
+		// k still gets stale the grace period before it expires
+		e.setStaleAt(t.UnixNano() - int64(c.refreshGrace))
+	}
+	if d := t.Sub(c.clock.Now()); d > 0 {
+		// replaces the job of k, which always looks up the current entry
+		c.scheduleExpiration(k, e)
+	} else {
+		c.removeExpired(k)
+	}
+	return nil
+}
+
+// getEntry returns the unexpired entry of k.
+func (c *cache) getEntry(k string) (*entry, bool) {
+	v, found := c.items.Get(k)
+	if !found {
+		return nil, false
+	}
+	e := v.(*entry)
+	if e.expired(c.now()) {
+		return nil, false
+	}
+	return e, true
+}
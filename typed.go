@@ -0,0 +1,121 @@
+package m_cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// KeyFunc turns a key into the string it is stored under, two different
+// keys must give two different strings.
+type KeyFunc[K comparable] func(k K) string
+
+// TypedCache is a type-safe view of a Cache, holding values of type V under
+// keys of type K.
+type TypedCache[K comparable, V any] struct {
+	c   *Cache
+	key KeyFunc[K]
+}
+
+// NewTyped returns a TypedCache storing its items in c. Without a KeyFunc,
+// strings are used as they are, integers in base 10, and any other key type
+// in its Go syntax representation.
+func NewTyped[K comparable, V any](c *Cache, key KeyFunc[K]) *TypedCache[K, V] {
+	if key == nil {
+		key = defaultKey[K]
+	}
+	return &TypedCache[K, V]{c: c, key: key}
+}
+
+func defaultKey[K comparable](k K) string {
+	switch v := any(k).(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	}
+	return fmt.Sprintf("%#v", k)
+}
+
+// Untyped returns the underlying Cache.
+func (t *TypedCache[K, V]) Untyped() *Cache {
+	return t.c
+}
+
+// Get returns the value of k, a value of another type stored through the
+// underlying Cache is reported as missing.
+func (t *TypedCache[K, V]) Get(k K) (V, bool) {
+	var zero V
+	x, found := t.c.Get(t.key(k))
+	if !found {
+		return zero, false
+	}
+	v, ok := x.(V)
+	if !ok {
+		return zero, false
+	}
+	return v, true
+}
+
+func (t *TypedCache[K, V]) Set(k K, v V, d time.Duration) {
+	t.c.Set(t.key(k), v, d)
+}
+
+func (t *TypedCache[K, V]) SetDefault(k K, v V) {
+	t.c.SetDefault(t.key(k), v)
+}
+
+func (t *TypedCache[K, V]) Add(k K, v V, d time.Duration) error {
+	return t.c.Add(t.key(k), v, d)
+}
+
+func (t *TypedCache[K, V]) Replace(k K, v V, d time.Duration) error {
+	return t.c.Replace(t.key(k), v, d)
+}
+
+func (t *TypedCache[K, V]) Delete(k K) {
+	t.c.Delete(t.key(k))
+}
+
+// GetOrLoad is Cache.GetOrLoad with a typed loader.
+func (t *TypedCache[K, V]) GetOrLoad(ctx context.Context, k K, loader func(ctx context.Context) (V, time.Duration, error)) (V, error) {
+	var zero V
+	x, err := t.c.GetOrLoad(ctx, t.key(k), func(ctx context.Context) (interface{}, time.Duration, error) {
+		return loader(ctx)
+	})
+	if err != nil {
+		return zero, err
+	}
+	v, ok := x.(V)
+	if !ok {
+		return zero, fmt.Errorf("item %s holds a %T", t.key(k), x)
+	}
+	return v, nil
+}
+
+func (t *TypedCache[K, V]) TTL(k K) (time.Duration, bool) {
+	return t.c.TTL(t.key(k))
+}
+
+func (t *TypedCache[K, V]) Touch(k K, d time.Duration) error {
+	return t.c.Touch(t.key(k), d)
+}